@@ -8,4 +8,4 @@ require (
 	golang.org/x/sys v0.13.0
 )
 
-require golang.org/x/net v0.17.0 // indirect
+require golang.org/x/net v0.17.0
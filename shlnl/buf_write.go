@@ -66,3 +66,27 @@ func WriteRtAttrToBuf(p *unix.RtAttr, b []byte) []byte {
 	buf = append(buf, b...)
 	return buf
 }
+
+func WriteRtMsgToBuf(p *unix.RtMsg) []byte {
+	var buf []byte = make([]byte, unix.SizeofRtMsg)
+	var i, l = 0, 0
+	buf[i] = p.Family
+	i += 1
+	buf[i] = p.Dst_len
+	i += 1
+	buf[i] = p.Src_len
+	i += 1
+	buf[i] = p.Tos
+	i += 1
+	buf[i] = p.Table
+	i += 1
+	buf[i] = p.Protocol
+	i += 1
+	buf[i] = p.Scope
+	i += 1
+	buf[i] = p.Type
+	i += 1
+	l = binary.Size(p.Flags)
+	binary.NativeEndian.PutUint32(buf[i:i+l], p.Flags)
+	return buf
+}
@@ -0,0 +1,142 @@
+package shlping
+
+import (
+	"encoding/binary"
+	"fmt"
+	"github.com/Senhnn/go_tool/shlnl"
+	"golang.org/x/sys/unix"
+	"math"
+	"net"
+	"syscall"
+)
+
+// checkBinding 检查绑定的网口、VRF和fwmark
+func (p *Pinger) checkBinding() error {
+	if p.Interface != "" && p.VRF != "" {
+		return fmt.Errorf("cannot bind to both interface %s and VRF %s", p.Interface, p.VRF)
+	}
+	if p.Mark < 0 || p.Mark > math.MaxUint32 {
+		return fmt.Errorf("invalid mark %d", p.Mark)
+	}
+	if p.Interface != "" {
+		_, err := net.InterfaceByName(p.Interface)
+		if err != nil {
+			return fmt.Errorf("interface %s: %w", p.Interface, err)
+		}
+	}
+	if p.VRF != "" {
+		kind, err := linkKind(p.VRF)
+		if err != nil {
+			return fmt.Errorf("VRF %s: %w", p.VRF, err)
+		}
+		if kind != "vrf" {
+			return fmt.Errorf("%s is not a VRF device", p.VRF)
+		}
+	}
+	return nil
+}
+
+// bindDevice 套接字绑定的设备，为网口或者VRF
+func (p *Pinger) bindDevice() string {
+	if p.Interface != "" {
+		return p.Interface
+	}
+	return p.VRF
+}
+
+// bindSocket 将套接字绑定到网口或者VRF，并设置fwmark
+func (p *Pinger) bindSocket(fd int) error {
+	if device := p.bindDevice(); device != "" {
+		err := unix.BindToDevice(fd, device)
+		if err != nil {
+			fmt.Println(fmt.Sprintf("Set socket SO_BINDTODEVICE:%s error:%s", device, err.Error()))
+			return err
+		}
+	}
+	if p.Mark != 0 {
+		err := unix.SetsockoptInt(fd, unix.SOL_SOCKET, unix.SO_MARK, p.Mark)
+		if err != nil {
+			fmt.Println(fmt.Sprintf("Set socket SO_MARK error:%s", err.Error()))
+			return err
+		}
+	}
+	return nil
+}
+
+// linkKind 通过netlink查询网口的类型，如"vrf"、"veth"，物理网口没有类型时返回空
+func linkKind(name string) (string, error) {
+	ifi, err := net.InterfaceByName(name)
+	if err != nil {
+		return "", err
+	}
+	sock, err := shlnl.NlSocket(unix.NETLINK_ROUTE)
+	if err != nil {
+		return "", err
+	}
+	defer unix.Close(sock)
+
+	data := make([]byte, 0, unix.NLMSG_HDRLEN+unix.SizeofIfInfomsg)
+	nlMsgHdr := &unix.NlMsghdr{
+		Len:   unix.NLMSG_HDRLEN + unix.SizeofIfInfomsg,
+		Type:  unix.RTM_GETLINK,
+		Flags: unix.NLM_F_REQUEST,
+		Seq:   1,
+	}
+	data = append(data, shlnl.WriteNlMsghdrToBuf(nlMsgHdr)...)
+	data = append(data, shlnl.WriteIfInfomsgToBuf(&unix.IfInfomsg{Family: unix.AF_UNSPEC, Index: int32(ifi.Index)})...)
+
+	err = unix.Sendto(sock, data, 0, &unix.SockaddrNetlink{Family: unix.AF_NETLINK})
+	if err != nil {
+		return "", err
+	}
+	buf := make([]byte, 8192)
+	n, _, err := unix.Recvfrom(sock, buf, 0)
+	if err != nil {
+		return "", err
+	}
+	msgs, err := syscall.ParseNetlinkMessage(buf[:n])
+	if err != nil {
+		return "", err
+	}
+	for i := range msgs {
+		switch msgs[i].Header.Type {
+		case unix.NLMSG_ERROR:
+			if len(msgs[i].Data) >= 4 {
+				if errno := int32(binary.NativeEndian.Uint32(msgs[i].Data)); errno != 0 {
+					return "", unix.Errno(-errno)
+				}
+			}
+		case unix.RTM_NEWLINK:
+			attrs, err := syscall.ParseNetlinkRouteAttr(&msgs[i])
+			if err != nil {
+				return "", err
+			}
+			for _, attr := range attrs {
+				if attr.Attr.Type == unix.IFLA_LINKINFO {
+					return parseInfoKind(attr.Value), nil
+				}
+			}
+		}
+	}
+	return "", nil
+}
+
+// parseInfoKind 从IFLA_LINKINFO的嵌套属性中取出IFLA_INFO_KIND
+func parseInfoKind(b []byte) string {
+	for len(b) >= unix.SizeofRtAttr {
+		l := int(binary.NativeEndian.Uint16(b[0:2]))
+		if l < unix.SizeofRtAttr || l > len(b) {
+			return ""
+		}
+		if binary.NativeEndian.Uint16(b[2:4]) == unix.IFLA_INFO_KIND {
+			kind := b[unix.SizeofRtAttr:l]
+			// 字符串以0结尾
+			for len(kind) > 0 && kind[len(kind)-1] == 0 {
+				kind = kind[:len(kind)-1]
+			}
+			return string(kind)
+		}
+		b = b[min(shlnl.RtaAlignOf(l), len(b)):]
+	}
+	return ""
+}
@@ -0,0 +1,119 @@
+package shlping
+
+import (
+	"fmt"
+	"golang.org/x/sys/unix"
+	"net"
+)
+
+// responder 广播和组播ping中的一个应答者
+type responder struct {
+	addr  *net.IPAddr
+	stats rttStats
+	// duplicates 该应答者对同一个序号的重复应答数
+	duplicates int
+	// seen 已经收到该应答者应答的序号，每个序号一位
+	seen [(1 << 16) / 64]uint64
+}
+
+// multiResponder 目的地址是否可能有多个应答者
+func (p *Pinger) multiResponder() bool {
+	return p.Broadcast || p.TargetIpaddr.IP.IsMulticast()
+}
+
+// checkBroadcast 广播和组播ping只支持ICMP探测
+func (p *Pinger) checkBroadcast() error {
+	if p.multiResponder() && p.ProbeType != ProbeICMP {
+		return fmt.Errorf("broadcast and multicast are only supported for ICMP probes")
+	}
+	return nil
+}
+
+// setupBroadcast 允许发送广播，组播时设置TTL（IPv6为跳数限制）和发送的网口
+func (p *Pinger) setupBroadcast(conn *icmpConn) error {
+	var err error
+	if p.Broadcast {
+		err = unix.SetsockoptInt(conn.fd, unix.SOL_SOCKET, unix.SO_BROADCAST, 1)
+		if err != nil {
+			fmt.Println(fmt.Sprintf("Set socket SO_BROADCAST error:%s", err.Error()))
+			return err
+		}
+	}
+	if !p.TargetIpaddr.IP.IsMulticast() {
+		return nil
+	}
+	var ifindex int
+	if p.MulticastInterface != "" {
+		ifi, err := net.InterfaceByName(p.MulticastInterface)
+		if err != nil {
+			return err
+		}
+		ifindex = ifi.Index
+	}
+	if conn.ipv4 {
+		err = unix.SetsockoptInt(conn.fd, unix.IPPROTO_IP, unix.IP_MULTICAST_TTL, p.TTL)
+		if err != nil {
+			fmt.Println(fmt.Sprintf("Set socket IP_MULTICAST_TTL error:%s", err.Error()))
+			return err
+		}
+		if ifindex != 0 {
+			err = unix.SetsockoptIPMreqn(conn.fd, unix.IPPROTO_IP, unix.IP_MULTICAST_IF, &unix.IPMreqn{Ifindex: int32(ifindex)})
+			if err != nil {
+				fmt.Println(fmt.Sprintf("Set socket IP_MULTICAST_IF error:%s", err.Error()))
+				return err
+			}
+		}
+		return nil
+	}
+	err = unix.SetsockoptInt(conn.fd, unix.IPPROTO_IPV6, unix.IPV6_MULTICAST_HOPS, p.TTL)
+	if err != nil {
+		fmt.Println(fmt.Sprintf("Set socket IPV6_MULTICAST_HOPS error:%s", err.Error()))
+		return err
+	}
+	if ifindex != 0 {
+		err = unix.SetsockoptInt(conn.fd, unix.IPPROTO_IPV6, unix.IPV6_MULTICAST_IF, ifindex)
+		if err != nil {
+			fmt.Println(fmt.Sprintf("Set socket IPV6_MULTICAST_IF error:%s", err.Error()))
+			return err
+		}
+	}
+	return nil
+}
+
+// responderAddr 应答者的地址，链路本地地址带上目的地址的网口
+func (p *Pinger) responderAddr(ip net.IP) *net.IPAddr {
+	addr := &net.IPAddr{IP: append(net.IP(nil), ip...)}
+	if ip.IsLinkLocalUnicast() {
+		addr.Zone = p.TargetIpaddr.Zone
+		if addr.Zone == "" {
+			addr.Zone = p.MulticastInterface
+		}
+	}
+	return addr
+}
+
+// recordResponder 按照应答者统计应答，同一个应答者对同一个序号的应答只计一次。调用方需持有p.lock
+func (p *Pinger) recordResponder(pkt *Packet) {
+	key := pkt.IPAddr.String()
+	r, ok := p.responderIndex[key]
+	if !ok {
+		r = &responder{addr: pkt.IPAddr}
+		p.responderIndex[key] = r
+		p.responders = append(p.responders, r)
+	}
+	word, bit := pkt.Seq/64, uint64(1)<<(pkt.Seq%64)
+	if r.seen[word]&bit != 0 {
+		r.duplicates++
+		return
+	}
+	r.seen[word] |= bit
+	r.stats.add(pkt.Rtt)
+}
+
+// resetResponders 发出请求时清除所有应答者对该序号的记录，序号会重新使用。调用方需持有p.lock
+func (p *Pinger) resetResponders(seq int) {
+	word, bit := seq/64, uint64(1)<<(seq%64)
+	for _, r := range p.responders {
+		r.seen[word] &^= bit
+	}
+}
@@ -1,17 +1,55 @@
 package main
 
 import (
+	"errors"
 	"flag"
 	"fmt"
 	"github.com/Senhnn/go_tool/shlping"
+	"math/bits"
+	"net"
+	"os"
+	"os/signal"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
 )
 
 var usage = `
 用法:
-    ping [-c count] [-t timeout] host
+    ping [-4|-6] [-c count] [-i interval] [-t deadline] [-W timeout] [-l ttl] [-s size] [-q] [-a] [-D]
+         [-f] [-A] [-H] [-Q tos] [-R] [-T tsonly|tsandaddr] [-P port] [-u] [-k] [-b]
+         [-I interface|address] [-V vrf] [-m mark] host
 样例:
+	-4：只使用IPv4
+	-6：只使用IPv6
+	-c：发包次数，收到count个应答或者发完后等待剩余应答（最多10s，指定-W时为-W时间）后退出
+	-i：ping间隔时间（单位为ms，默认1000）
+	-t：总的运行时间，如10s，超过后不论收到多少应答都退出
+	-W：每个请求等待应答的时间，如2s，超过后到达的应答不计入统计（默认不限制）
 	-l：设置TTL（默认64）
-	-i：ping间隔时间（单位为ms）
+	-s：负载的大小（默认56字节，ICMP不能小于24字节，UDP不能小于2字节）
+	-q：不输出每个包的结果，只输出统计
+	-a：收到应答时响铃
+	-D：每一行前输出UNIX时间戳
+	-f：泛洪模式，每发送一个请求输出"."，收到应答时删除一个"."，只有root用户可以使用
+	-A：自适应模式，发包间隔跟随RTT，非root用户不小于2ms
+	-H：结束时输出RTT直方图
+	-Q：探测包的TOS（IPv6为流量类别），高6位为DSCP，低2位为ECN，如EF为0xb8
+	-R：记录路由
+	-T：时间戳选项，tsonly只记录时间戳，tsandaddr记录地址和时间戳
+	-P：使用TCP SYN探测该端口，收到SYN-ACK或者RST都算作应答。非root用户通过connect探测
+	-u：使用UDP探测，收到端口不可达或者应用程序的应答都算作应答。-P指定目的端口，
+	    不指定时与traceroute相同从33434开始依次使用不同的端口
+	-k：使用内核时间戳计算RTT，并输出收发时间的来源（user、software、hardware）
+	-b：允许ping广播地址。广播和组播地址的每个应答者分别统计，同一序号之后的应答标记为DUP
+	-I：为地址时作为源地址，为网口名时绑定到该网口，组播也从该网口发出
+	-V：绑定到VRF设备，按照VRF的路由表发送
+	-m：探测包的fwmark，用于匹配策略路由
+返回值:
+	与iputils ping相同，收到应答时返回0；没有收到任何应答，或者指定了-c和-t但应答数不足count时返回1；
+	其他错误返回2。非root用户使用ICMP数据报套接字，需要所在用户组在net.ipv4.ping_group_range范围内
     # 持续ping
     ping www.google.com
 
@@ -20,48 +58,335 @@ var usage = `
 
     # ping并且设置10秒超时
     ping -t 10s www.google.com
+
+    # 每200ms ping一次，只输出统计
+    ping -q -i 200 -c 50 www.google.com
+
+    # 探测443端口
+    ping -P 443 www.google.com
+
+    # 使用UDP探测53端口
+    ping -u -P 53 8.8.8.8
+
+    # 发现网段内的主机
+    ping -b 192.168.1.255
+
+    # 检查某个上联口的连通性
+    ping -I eth1 8.8.8.8
 `
 
 func main() {
-	//timeout := flag.Duration("t", time.Second*10, "")
-	//count := flag.Int("c", -1, "")
-	//interval := flag.Int("i", 1000, "")
-	//ttl := flag.Int("l", 64, "TTL")
+	os.Exit(run())
+}
+
+// run 执行ping并返回进程的退出码
+func run() int {
+	ipv4 := flag.Bool("4", false, "")
+	ipv6 := flag.Bool("6", false, "")
+	count := flag.Int("c", -1, "")
+	interval := flag.Int("i", 1000, "")
+	deadline := flag.Duration("t", 0, "")
+	replyTimeout := flag.Duration("W", 0, "")
+	ttl := flag.Int("l", 64, "")
+	size := flag.Int("s", 56, "")
+	quiet := flag.Bool("q", false, "")
+	audible := flag.Bool("a", false, "")
+	printTimestamp := flag.Bool("D", false, "")
+	flood := flag.Bool("f", false, "")
+	adaptive := flag.Bool("A", false, "")
+	histogram := flag.Bool("H", false, "")
+	tos := flag.String("Q", "0", "")
+	recordRoute := flag.Bool("R", false, "")
+	timestamp := flag.String("T", "", "")
+	port := flag.Int("P", 0, "")
+	udp := flag.Bool("u", false, "")
+	kernelTimestamps := flag.Bool("k", false, "")
+	broadcast := flag.Bool("b", false, "")
+	iface := flag.String("I", "", "")
+	vrf := flag.String("V", "", "")
+	mark := flag.Int("m", 0, "")
 
 	flag.Usage = func() {
 		fmt.Print(usage)
 	}
 	flag.Parse()
 
-	if flag.NArg() == 0 {
+	if flag.NArg() != 1 {
 		flag.Usage()
-		return
+		return 2
+	}
+	if *ipv4 && *ipv6 {
+		fmt.Println("ERROR: only one of -4 and -6 can be specified")
+		return 2
 	}
 
 	host := flag.Arg(0)
 	pinger, err := shlping.NewPinger(host)
+	switch {
+	case *ipv4:
+		pinger.SetNetwork("ip4")
+		err = pinger.Resolve()
+	case *ipv6:
+		pinger.SetNetwork("ip6")
+		err = pinger.Resolve()
+	}
 	if err != nil {
 		fmt.Println("ERROR:", err)
-		return
+		return 2
+	}
+
+	tosValue, err := strconv.ParseUint(*tos, 0, 8)
+	if err != nil {
+		fmt.Println("ERROR: invalid TOS:", *tos)
+		return 2
+	}
+	pinger.DSCP = int(tosValue >> 2)
+	pinger.ECN = int(tosValue & 0x3)
+	pinger.RecordRoute = *recordRoute
+	switch *timestamp {
+	case "":
+	case "tsonly":
+		pinger.Timestamp = shlping.TimestampOnly
+	case "tsandaddr":
+		pinger.Timestamp = shlping.TimestampAndAddr
+	default:
+		fmt.Println("ERROR: invalid timestamp type:", *timestamp)
+		return 2
 	}
 
-	pinger.OnRecv = func(pkt *shlping.Packet) {
-		fmt.Printf("%d bytes from %s: icmp_seq=%d time=%v ttl=%v\n",
-			pkt.Nbytes, pkt.IPAddr, pkt.Seq, pkt.Rtt, pkt.Ttl)
+	// 没有权限建立原始套接字时使用ICMP数据报套接字，TCP探测通过connect
+	pinger.SetPrivileged(os.Geteuid() == 0)
+	switch {
+	case *udp:
+		pinger.ProbeType = shlping.ProbeUDP
+		pinger.Port = *port
+	case *port > 0:
+		pinger.ProbeType = shlping.ProbeTCP
+		pinger.Port = *port
 	}
-	pinger.OnDuplicateRecv = func(pkt *shlping.Packet) {
-		fmt.Printf("%d bytes from %s: icmp_seq=%d time=%v ttl=%v (DUP!)\n",
-			pkt.Nbytes, pkt.IPAddr, pkt.Seq, pkt.Rtt, pkt.Ttl)
+	// seqName 输出中序号的名字，与探测协议对应
+	seqName := "icmp_seq"
+	switch pinger.ProbeType {
+	case shlping.ProbeTCP:
+		seqName = "tcp_seq"
+	case shlping.ProbeUDP:
+		seqName = "udp_seq"
 	}
 
-	//pinger.Count = *count
-	//pinger.Interval = time.Duration(*interval)
-	//pinger.Timeout = (*timeout) * time.Millisecond
-	//pinger.TTL = *ttl
+	// printf 输出一行结果，-D时在前面加上UNIX时间戳
+	printf := func(format string, a ...any) {
+		if *printTimestamp {
+			now := time.Now()
+			fmt.Printf("[%d.%06d] ", now.Unix(), now.Nanosecond()/1000)
+		}
+		fmt.Printf(format, a...)
+	}
+	if !*quiet {
+		pinger.OnRecv = func(pkt *shlping.Packet) {
+			switch {
+			case pinger.ProbeType == shlping.ProbeTCP:
+				printf("%d bytes from %s: tcp_seq=%d flags=%s time=%v ttl=%v\n",
+					pkt.Nbytes, net.JoinHostPort(pkt.IPAddr.String(), strconv.Itoa(pinger.Port)), pkt.Seq,
+					tcpFlags(pkt.TCPFlags), pkt.Rtt, pkt.Ttl)
+			case pkt.PortUnreachable:
+				printf("port unreachable from %s: udp_seq=%d time=%v\n", pkt.IPAddr, pkt.Seq, pkt.Rtt)
+			case pinger.ProbeType == shlping.ProbeUDP:
+				printf("%d bytes from %s: udp_seq=%d time=%v ttl=%v\n",
+					pkt.Nbytes, pkt.IPAddr, pkt.Seq, pkt.Rtt, pkt.Ttl)
+			default:
+				printf("%d bytes from %s: icmp_seq=%d time=%v ttl=%v\n",
+					pkt.Nbytes, pkt.IPAddr, pkt.Seq, pkt.Rtt, pkt.Ttl)
+			}
+			if *kernelTimestamps {
+				fmt.Printf("\trx=%v tx=%v\n", pkt.RecvTimestamp, pkt.SendTimestamp)
+			}
+			printOptions(pkt.Options)
+			if *audible {
+				fmt.Print("\a")
+			}
+		}
+		pinger.OnDuplicateRecv = func(pkt *shlping.Packet) {
+			printf("%d bytes from %s: %s=%d time=%v ttl=%v (DUP!)\n",
+				pkt.Nbytes, pkt.IPAddr, seqName, pkt.Seq, pkt.Rtt, pkt.Ttl)
+		}
+		pinger.OnError = func(pkt *shlping.Packet, err error) {
+			printf("%s=%d %v\n", seqName, pkt.Seq, err)
+		}
+	}
+
+	pinger.Count = *count
+	pinger.Interval = time.Duration(*interval) * time.Millisecond
+	if *deadline > 0 {
+		pinger.Timeout = *deadline
+	}
+	pinger.ReplyTimeout = *replyTimeout
+	pinger.TTL = *ttl
+	pinger.Size = *size
+	pinger.KernelTimestamps = *kernelTimestamps
+	pinger.Broadcast = *broadcast
+	if net.ParseIP(*iface) != nil {
+		pinger.SourceAddr = *iface
+	} else {
+		pinger.Interface = *iface
+		pinger.MulticastInterface = *iface
+	}
+	pinger.VRF = *vrf
+	pinger.Mark = *mark
+	pinger.Flood = *flood
+	pinger.Adaptive = *adaptive
+	if pinger.Flood && !*quiet {
+		// 与iputils ping相同，发送时输出"."，收到应答时退格删除，剩下的"."为没有应答的请求
+		pinger.OnSend = func(*shlping.Packet) {
+			fmt.Print(".")
+		}
+		pinger.OnRecv = func(*shlping.Packet) {
+			fmt.Print("\b \b")
+		}
+		pinger.OnDuplicateRecv = nil
+		pinger.OnError = func(*shlping.Packet, error) {
+			fmt.Print("\bE")
+		}
+	}
+
+	var stats *shlping.Statistics
+	pinger.OnFinish = func(s *shlping.Statistics) {
+		stats = s
+		printStatistics(s)
+		if *histogram {
+			printHistogram(s.Histogram)
+		}
+	}
+
+	// Ctrl-C时停止ping，由OnFinish输出统计信息
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, os.Interrupt)
+	go func() {
+		<-c
+		pinger.Stop()
+	}()
 
 	fmt.Printf("PING %s (%s):\n", pinger.TargetAddr, pinger.TargetIpaddr)
 	err = pinger.Run()
 	if err != nil {
 		fmt.Println("Failed to ping target host:", err)
+		if errors.Is(err, syscall.EACCES) && !pinger.Broadcast {
+			fmt.Println("Do you want to ping broadcast? Then -b.")
+		}
+		return 2
+	}
+	// 与iputils ping相同，没有应答，或者指定了总时间但没有收齐count个应答时返回1
+	if stats.PacketsRecv == 0 || (*deadline > 0 && *count > 0 && stats.PacketsRecv < *count) {
+		return 1
+	}
+	return 0
+}
+
+// tcpFlags 按照hping的格式输出TCP应答的标志位，SA表示端口开放，RA表示端口关闭
+func tcpFlags(flags int) string {
+	var s string
+	if flags&0x02 != 0 {
+		s += "S"
+	}
+	if flags&0x04 != 0 {
+		s += "R"
+	}
+	if flags&0x10 != 0 {
+		s += "A"
+	}
+	return s
+}
+
+// printOptions 按照iputils ping的格式输出应答中的记录路由和时间戳
+func printOptions(opts *shlping.IPv4Options) {
+	if opts == nil {
+		return
+	}
+	for i, addr := range opts.RecordRoute {
+		if i == 0 {
+			fmt.Printf("RR: \t%s\n", addr)
+		} else {
+			fmt.Printf("\t%s\n", addr)
+		}
+	}
+	for i, stamp := range opts.Timestamps {
+		prefix := "\t"
+		if i == 0 {
+			prefix = "TS: \t"
+		}
+		if stamp.Addr != nil {
+			fmt.Printf("%s%s\t%d absolute\n", prefix, stamp.Addr, stamp.Time)
+		} else {
+			fmt.Printf("%s%d absolute\n", prefix, stamp.Time)
+		}
+	}
+	if opts.TimestampOverflow > 0 {
+		fmt.Printf("Unrecorded hops: %d\n", opts.TimestampOverflow)
+	}
+	fmt.Println()
+}
+
+func printStatistics(stats *shlping.Statistics) {
+	fmt.Printf("\n--- %s ping statistics ---\n", stats.Addr)
+	fmt.Printf("%d packets transmitted, %d packets received, %d duplicates, %d errors, %v%% packet loss\n",
+		stats.PacketsSent, stats.PacketsRecv, stats.PacketsRecvDuplicates, stats.PacketsErrors, stats.PacketLoss)
+	fmt.Printf("round-trip min/avg/max/stddev = %v/%v/%v/%v\n",
+		stats.MinRtt, stats.AvgRtt, stats.MaxRtt, stats.StdDevRtt)
+	fmt.Printf("round-trip p50/p90/p99/p99.9 = %v/%v/%v/%v, jitter = %v\n",
+		stats.P50Rtt, stats.P90Rtt, stats.P99Rtt, stats.P999Rtt, stats.Jitter)
+	for _, r := range stats.Responders {
+		fmt.Printf("%s: %d received, %d duplicates, %v%% packet loss, min/avg/max/stddev = %v/%v/%v/%v\n",
+			r.IPAddr, r.PacketsRecv, r.PacketsRecvDuplicates, r.PacketLoss, r.MinRtt, r.AvgRtt, r.MaxRtt, r.StdDevRtt)
+	}
+	// 只有一类且为尽力而为时不输出按DSCP分类的统计
+	if _, ok := stats.DSCPStats[0]; ok && len(stats.DSCPStats) == 1 {
+		return
+	}
+	dscps := make([]int, 0, len(stats.DSCPStats))
+	for dscp := range stats.DSCPStats {
+		dscps = append(dscps, dscp)
+	}
+	sort.Ints(dscps)
+	for _, dscp := range dscps {
+		d := stats.DSCPStats[dscp]
+		fmt.Printf("dscp %d: %d received, min/avg/max/stddev = %v/%v/%v/%v\n",
+			dscp, d.PacketsRecv, d.MinRtt, d.AvgRtt, d.MaxRtt, d.StdDevRtt)
+	}
+}
+
+// histogramWidth 直方图中最长的条的宽度
+const histogramWidth = 50
+
+// printHistogram 将直方图的桶按照2的幂合并后输出，每一行为[下界, 上界)之间的包数
+func printHistogram(h *shlping.RTTHistogram) {
+	type row struct {
+		lower, upper time.Duration
+		count        uint64
+	}
+	var rows []*row
+	for _, b := range h.Buckets() {
+		lower := time.Duration(1) << (bits.Len64(uint64(b.Lower)) - 1)
+		if b.Lower == 0 {
+			lower = 0
+		}
+		if len(rows) == 0 || rows[len(rows)-1].lower != lower {
+			upper := lower * 2
+			if lower == 0 {
+				upper = 1
+			}
+			rows = append(rows, &row{lower: lower, upper: upper})
+		}
+		rows[len(rows)-1].count += b.Count
+	}
+	var maxCount uint64
+	for _, r := range rows {
+		maxCount = max(maxCount, r.count)
+	}
+	fmt.Println("\nround-trip histogram:")
+	for _, r := range rows {
+		bar := int(r.count * histogramWidth / maxCount)
+		if bar == 0 {
+			bar = 1
+		}
+		fmt.Printf("%12v - %-12v |%-*s %d\n", r.lower, r.upper, histogramWidth, strings.Repeat("#", bar), r.count)
 	}
 }
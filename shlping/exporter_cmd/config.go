@@ -0,0 +1,112 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+)
+
+// duration 配置文件中以"1s"、"500ms"形式书写的时间
+type duration time.Duration
+
+func (d *duration) UnmarshalJSON(b []byte) error {
+	var s string
+	err := json.Unmarshal(b, &s)
+	if err != nil {
+		return err
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = duration(v)
+	return nil
+}
+
+// config 配置文件
+type config struct {
+	// Listen HTTP监听地址
+	Listen string `json:"listen"`
+	// Privileged 是否使用原始套接字，默认使用非特权的ICMP数据报套接字
+	Privileged bool `json:"privileged"`
+	// Interval 默认的探测间隔
+	Interval duration `json:"interval"`
+	// Timeout 探测包超过该时间没有应答记为丢失
+	Timeout duration `json:"timeout"`
+	// DownAfter 连续丢失多少个探测包后认为目标不可达
+	DownAfter int `json:"down_after"`
+	// Buckets RTT直方图的上界，单位为秒
+	Buckets []float64 `json:"buckets"`
+	// Targets 探测目标
+	Targets []*targetConfig `json:"targets"`
+}
+
+// targetConfig 一个探测目标
+type targetConfig struct {
+	// Name 指标中target标签的值，默认为地址
+	Name string `json:"name"`
+	// Addr 目标地址或域名
+	Addr string `json:"addr"`
+	// Network 为"ip","ip4","ip6"，默认为"ip"
+	Network string `json:"network"`
+	// Interval 探测间隔，默认使用全局的间隔
+	Interval duration `json:"interval"`
+	// Size 负载大小
+	Size int `json:"size"`
+	// DSCP 探测包的DSCP
+	DSCP int `json:"dscp"`
+}
+
+var defaultBuckets = []float64{0.0005, 0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5}
+
+// loadConfig 读取配置文件并填写默认值
+func loadConfig(path string) (*config, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	c := &config{
+		Listen:    "127.0.0.1:9427",
+		Interval:  duration(time.Second),
+		Timeout:   duration(2 * time.Second),
+		DownAfter: 3,
+		Buckets:   defaultBuckets,
+	}
+	err = json.Unmarshal(b, c)
+	if err != nil {
+		return nil, fmt.Errorf("parse %s: %w", path, err)
+	}
+	if len(c.Targets) == 0 {
+		return nil, errors.New("no targets")
+	}
+	if c.Interval <= 0 || c.Timeout <= 0 || c.DownAfter <= 0 {
+		return nil, errors.New("interval, timeout and down_after must be positive")
+	}
+	for i := 1; i < len(c.Buckets); i++ {
+		if c.Buckets[i] <= c.Buckets[i-1] {
+			return nil, errors.New("buckets must be sorted in increasing order")
+		}
+	}
+	names := make(map[string]bool)
+	for _, t := range c.Targets {
+		if t.Addr == "" {
+			return nil, errors.New("target addr cannot be empty")
+		}
+		if t.Name == "" {
+			t.Name = t.Addr
+		}
+		if names[t.Name] {
+			return nil, fmt.Errorf("duplicate target name %s", t.Name)
+		}
+		names[t.Name] = true
+		if t.Network == "" {
+			t.Network = "ip"
+		}
+		if t.Interval <= 0 {
+			t.Interval = c.Interval
+		}
+	}
+	return c, nil
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/Senhnn/go_tool/shlping"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+var usage = `
+用法:
+    ping_exporter [-config file] [-listen addr]
+样例:
+	-config：配置文件（默认ping_exporter.json）
+	-listen：HTTP监听地址，覆盖配置文件中的listen
+    # 配置文件
+    {
+        "listen": "127.0.0.1:9427",
+        "interval": "1s",
+        "timeout": "2s",
+        "down_after": 3,
+        "targets": [
+            {"name": "gateway", "addr": "192.168.0.1"},
+            {"addr": "www.google.com", "network": "ip6", "interval": "5s", "dscp": 46}
+        ]
+    }
+
+    # 启动后从/metrics获取指标
+    ping_exporter -config ping_exporter.json
+    curl http://127.0.0.1:9427/metrics
+`
+
+// roundLength 有目标解析失败时，MultiPinger运行该时长后重新建立，重新解析这些目标
+const roundLength = time.Hour
+
+// retryDelay MultiPinger出错或者有目标发送失败后重新建立的间隔
+const retryDelay = 10 * time.Second
+
+func main() {
+	configPath := flag.String("config", "ping_exporter.json", "")
+	listen := flag.String("listen", "", "")
+
+	flag.Usage = func() {
+		fmt.Print(usage)
+	}
+	flag.Parse()
+
+	c, err := loadConfig(*configPath)
+	if err != nil {
+		fmt.Println("ERROR:", err)
+		os.Exit(2)
+	}
+	if *listen != "" {
+		c.Listen = *listen
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	reg := &registry{bounds: c.Buckets}
+	for _, tc := range c.Targets {
+		reg.targets = append(reg.targets, newTargetMetrics(tc.Name, len(c.Buckets)))
+	}
+	go probe(ctx, c, reg)
+	go expireLoop(ctx, reg, time.Duration(c.Timeout), c.DownAfter)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		err := reg.writeTo(w)
+		if err != nil {
+			fmt.Println("Write metrics error:", err)
+		}
+	})
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/" {
+			http.NotFound(w, r)
+			return
+		}
+		fmt.Fprint(w, `<html><head><title>ping exporter</title></head><body><a href="/metrics">Metrics</a></body></html>`)
+	})
+	server := &http.Server{Addr: c.Listen, Handler: mux}
+	go func() {
+		<-ctx.Done()
+		shutdown, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		server.Shutdown(shutdown)
+	}()
+
+	fmt.Printf("Listening on %s, probing %d targets\n", c.Listen, len(c.Targets))
+	err = server.ListenAndServe()
+	if err != nil && !errors.Is(err, http.ErrServerClosed) {
+		fmt.Println("ERROR:", err)
+		os.Exit(1)
+	}
+}
+
+// probe 使用一个MultiPinger探测所有目标直到ctx被取消，每个协议族只有一个套接字。
+// MultiPinger结束后等待retryDelay重新建立
+func probe(ctx context.Context, c *config, reg *registry) {
+	for round := 0; ctx.Err() == nil; round++ {
+		err := probeRound(ctx, c, reg, round)
+		if ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			fmt.Printf("Probe error:%s\n", err)
+		}
+		select {
+		case <-ctx.Done():
+		case <-time.After(retryDelay):
+		}
+	}
+}
+
+// probeRound 建立一个MultiPinger探测所有能够解析的目标，一直运行到ctx被取消或者有目标发送失败。
+// 有目标解析失败时最多运行roundLength
+func probeRound(ctx context.Context, c *config, reg *registry, round int) error {
+	m := shlping.NewMultiPinger()
+	m.SetPrivileged(c.Privileged)
+	for i, tc := range c.Targets {
+		t := reg.targets[i]
+		m.SetNetwork(tc.Network)
+		pinger, err := m.AddTarget(tc.Addr)
+		if err != nil {
+			fmt.Printf("Resolve %s error:%s\n", tc.Name, err)
+			m.Timeout = roundLength
+			continue
+		}
+		t.setAddr(pinger.TargetIpaddr.String())
+
+		pinger.Interval = time.Duration(tc.Interval)
+		pinger.DSCP = tc.DSCP
+		// 指标在回调中累计，Pinger不需要保存每个包的RTT
+		pinger.RecordRtts = false
+		if tc.Size > 0 {
+			pinger.Size = tc.Size
+		}
+		pinger.OnSend = func(pkt *shlping.Packet) {
+			t.onSend(probeKey{round: round, seq: pkt.Seq})
+		}
+		pinger.OnRecv = func(pkt *shlping.Packet) {
+			t.onRecv(probeKey{round: round, seq: pkt.Seq}, pkt.Rtt, c.Buckets)
+		}
+		pinger.OnDuplicateRecv = func(*shlping.Packet) {
+			t.onDuplicate()
+		}
+		pinger.OnError = func(_ *shlping.Packet, err error) {
+			t.onError(err)
+		}
+		// 目标发送失败后MultiPinger不再探测它，停止后重新建立
+		pinger.OnFinish = func(*shlping.Statistics) {
+			m.Stop()
+		}
+	}
+	if len(m.Targets()) == 0 {
+		return errors.New("no target can be resolved")
+	}
+	return m.RunWithContext(ctx)
+}
+
+// expireLoop 定期将超时的探测包计为丢失
+func expireLoop(ctx context.Context, reg *registry, timeout time.Duration, downAfter int) {
+	ticker := time.NewTicker(timeout / 4)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			for _, t := range reg.targets {
+				t.expire(timeout, downAfter)
+			}
+		}
+	}
+}
@@ -0,0 +1,265 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/Senhnn/go_tool/shlping"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// errorTypes 差错报文类型，作为icmp_errors_total的type标签
+var errorTypes = []string{"unreachable", "time_exceeded", "parameter_problem", "redirect"}
+
+// targetMetrics 一个目标的指标。探测包在收到应答或者超时之前记在outstanding中，
+// 超时后计入丢失，与MultiPinger重新建立无关
+type targetMetrics struct {
+	name string
+	addr string
+
+	lock       sync.Mutex
+	sent       uint64
+	received   uint64
+	lost       uint64
+	duplicates uint64
+	errors     map[string]uint64
+	// buckets 每个上界的累计计数，最后一个为+Inf
+	buckets []uint64
+	rttSum  float64
+	lastRtt time.Duration
+	// consecutiveLost 连续丢失的探测包数
+	consecutiveLost int
+	up              bool
+	outstanding     map[probeKey]time.Time
+}
+
+// probeKey 重新建立MultiPinger后序号会从0开始，用轮数区分
+type probeKey struct {
+	round int
+	seq   int
+}
+
+func newTargetMetrics(name string, bucketCount int) *targetMetrics {
+	return &targetMetrics{
+		name:        name,
+		errors:      make(map[string]uint64),
+		buckets:     make([]uint64, bucketCount+1),
+		outstanding: make(map[probeKey]time.Time),
+	}
+}
+
+func (t *targetMetrics) setAddr(addr string) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.addr = addr
+}
+
+func (t *targetMetrics) onSend(key probeKey) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.sent++
+	t.outstanding[key] = time.Now()
+}
+
+func (t *targetMetrics) onRecv(key probeKey, rtt time.Duration, bounds []float64) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if _, ok := t.outstanding[key]; !ok {
+		// 已经超时计入丢失的探测包不再计入收到
+		return
+	}
+	delete(t.outstanding, key)
+	t.received++
+	t.consecutiveLost = 0
+	t.up = true
+	t.lastRtt = rtt
+	seconds := rtt.Seconds()
+	t.rttSum += seconds
+	i := sort.SearchFloat64s(bounds, seconds)
+	t.buckets[i]++
+}
+
+func (t *targetMetrics) onDuplicate() {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.duplicates++
+}
+
+func (t *targetMetrics) onError(err error) {
+	var unreachable *shlping.UnreachableError
+	var timeExceeded *shlping.TimeExceededError
+	var paramProblem *shlping.ParameterProblemError
+	typ := "redirect"
+	switch {
+	case errors.As(err, &unreachable):
+		typ = "unreachable"
+	case errors.As(err, &timeExceeded):
+		typ = "time_exceeded"
+	case errors.As(err, &paramProblem):
+		typ = "parameter_problem"
+	}
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.errors[typ]++
+}
+
+// expire 将超过timeout没有应答的探测包计为丢失
+func (t *targetMetrics) expire(timeout time.Duration, downAfter int) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	now := time.Now()
+	for key, sentAt := range t.outstanding {
+		if now.Sub(sentAt) < timeout {
+			continue
+		}
+		delete(t.outstanding, key)
+		t.lost++
+		t.consecutiveLost++
+		if t.consecutiveLost >= downAfter {
+			t.up = false
+		}
+	}
+}
+
+// registry 所有目标的指标
+type registry struct {
+	bounds  []float64
+	targets []*targetMetrics
+}
+
+// metricWriter 按照Prometheus文本格式输出指标
+type metricWriter struct {
+	w   io.Writer
+	err error
+}
+
+func (m *metricWriter) printf(format string, a ...interface{}) {
+	if m.err != nil {
+		return
+	}
+	_, m.err = fmt.Fprintf(m.w, format, a...)
+}
+
+func (m *metricWriter) header(name, typ, help string) {
+	m.printf("# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+}
+
+func (m *metricWriter) sample(name, labels string, value float64) {
+	m.printf("%s{%s} %s\n", name, labels, formatFloat(value))
+}
+
+// writeTo 输出所有指标，同一个指标的样本连续输出
+func (r *registry) writeTo(w io.Writer) error {
+	snapshots := make([]*targetMetrics, 0, len(r.targets))
+	for _, t := range r.targets {
+		snapshots = append(snapshots, t.snapshot())
+	}
+
+	m := &metricWriter{w: w}
+	counters := []struct {
+		name, help string
+		value      func(*targetMetrics) uint64
+	}{
+		{"shlping_probes_sent_total", "Number of echo requests sent.", func(t *targetMetrics) uint64 { return t.sent }},
+		{"shlping_probes_received_total", "Number of echo replies received before the timeout.", func(t *targetMetrics) uint64 { return t.received }},
+		{"shlping_probes_lost_total", "Number of echo requests without a reply before the timeout.", func(t *targetMetrics) uint64 { return t.lost }},
+		{"shlping_probes_duplicate_total", "Number of duplicate echo replies received.", func(t *targetMetrics) uint64 { return t.duplicates }},
+	}
+	for _, c := range counters {
+		m.header(c.name, "counter", c.help)
+		for _, t := range snapshots {
+			m.sample(c.name, t.labels(), float64(c.value(t)))
+		}
+	}
+
+	m.header("shlping_icmp_errors_total", "counter", "Number of ICMP error messages received about echo requests.")
+	for _, t := range snapshots {
+		for _, typ := range errorTypes {
+			m.sample("shlping_icmp_errors_total", t.labels()+`,type="`+typ+`"`, float64(t.errors[typ]))
+		}
+	}
+
+	m.header("shlping_target_up", "gauge", "Whether the target answered recently, 0 after down_after consecutive losses.")
+	for _, t := range snapshots {
+		m.sample("shlping_target_up", t.labels(), boolFloat(t.up))
+	}
+
+	m.header("shlping_last_rtt_seconds", "gauge", "Round trip time of the latest echo reply.")
+	for _, t := range snapshots {
+		if t.received > 0 {
+			m.sample("shlping_last_rtt_seconds", t.labels(), t.lastRtt.Seconds())
+		}
+	}
+
+	m.header("shlping_rtt_seconds", "histogram", "Round trip time of echo replies.")
+	for _, t := range snapshots {
+		var cumulative uint64
+		for i, bound := range r.bounds {
+			cumulative += t.buckets[i]
+			m.sample("shlping_rtt_seconds_bucket", t.labels()+`,le="`+formatFloat(bound)+`"`, float64(cumulative))
+		}
+		cumulative += t.buckets[len(r.bounds)]
+		m.sample("shlping_rtt_seconds_bucket", t.labels()+`,le="+Inf"`, float64(cumulative))
+		m.sample("shlping_rtt_seconds_sum", t.labels(), t.rttSum)
+		m.sample("shlping_rtt_seconds_count", t.labels(), float64(cumulative))
+	}
+	return m.err
+}
+
+// snapshot 复制当前的指标，输出时不需要持有锁
+func (t *targetMetrics) snapshot() *targetMetrics {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	s := &targetMetrics{
+		name:       t.name,
+		addr:       t.addr,
+		sent:       t.sent,
+		received:   t.received,
+		lost:       t.lost,
+		duplicates: t.duplicates,
+		errors:     make(map[string]uint64, len(t.errors)),
+		buckets:    append([]uint64(nil), t.buckets...),
+		rttSum:     t.rttSum,
+		lastRtt:    t.lastRtt,
+		up:         t.up,
+	}
+	for typ, n := range t.errors {
+		s.errors[typ] = n
+	}
+	return s
+}
+
+func (t *targetMetrics) labels() string {
+	return `target="` + escapeLabel(t.name) + `",addr="` + escapeLabel(t.addr) + `"`
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// escapeLabel 转义标签值中的反斜杠、双引号和换行
+func escapeLabel(s string) string {
+	return labelEscaper.Replace(s)
+}
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+func boolFloat(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"github.com/Senhnn/go_tool/shlping"
+	"os"
+	"os/signal"
+	"time"
+)
+
+var usage = `
+用法:
+    fping [-c count] [-p period] [-t wait] [-u] [-q] host...
+样例:
+	-c：每个目标发包次数，不指定时每个目标只判断是否存活
+	-p：同一目标两次发包的间隔（单位为ms，默认1000）
+	-t：发完最后一个包后等待应答的时间（单位为ms，默认1000）
+	-u：使用非特权的ICMP数据报套接字
+	-q：不输出每个包的结果，只输出统计
+    # 判断多个主机是否存活
+    fping 192.168.0.1 192.168.0.2 www.google.com
+
+    # 每个主机ping5次，间隔200ms
+    fping -c 5 -p 200 192.168.0.1 192.168.0.2
+`
+
+func main() {
+	count := flag.Int("c", 0, "")
+	period := flag.Int("p", 1000, "")
+	wait := flag.Int("t", 1000, "")
+	unprivileged := flag.Bool("u", false, "")
+	quiet := flag.Bool("q", false, "")
+
+	flag.Usage = func() {
+		fmt.Print(usage)
+	}
+	flag.Parse()
+
+	if flag.NArg() == 0 {
+		flag.Usage()
+		return
+	}
+
+	multi := shlping.NewMultiPinger()
+	multi.SetPrivileged(!*unprivileged)
+	multi.Wait = time.Duration(*wait) * time.Millisecond
+
+	// 不指定-c时只判断是否存活
+	aliveOnly := *count <= 0
+	for _, host := range flag.Args() {
+		pinger, err := multi.AddTarget(host)
+		if err != nil {
+			fmt.Printf("%s: %s\n", host, err)
+			continue
+		}
+		pinger.Interval = time.Duration(*period) * time.Millisecond
+		pinger.Count = *count
+		if aliveOnly {
+			pinger.Count = 1
+		}
+		if !aliveOnly && !*quiet {
+			pinger.OnRecv = func(pkt *shlping.Packet) {
+				stats := pinger.Statistics()
+				fmt.Printf("%s : [%d], %d bytes, %v (%v avg, %v%% loss)\n",
+					pkt.Addr, pkt.Seq, pkt.Nbytes, pkt.Rtt, stats.AvgRtt, stats.PacketLoss)
+			}
+			pinger.OnDuplicateRecv = func(pkt *shlping.Packet) {
+				fmt.Printf("%s : duplicate for [%d], %d bytes, %v\n",
+					pkt.Addr, pkt.Seq, pkt.Nbytes, pkt.Rtt)
+			}
+			pinger.OnError = func(pkt *shlping.Packet, err error) {
+				fmt.Printf("%s : [%d], %v\n", pkt.Addr, pkt.Seq, err)
+			}
+		}
+	}
+	if len(multi.Targets()) == 0 {
+		os.Exit(2)
+	}
+
+	// Ctrl-C时停止，由OnFinish输出统计信息
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, os.Interrupt)
+	go func() {
+		<-c
+		multi.Stop()
+	}()
+
+	unreachable := 0
+	multi.OnFinish = func(stats []*shlping.Statistics) {
+		if !aliveOnly {
+			fmt.Println()
+		}
+		for _, s := range stats {
+			if s.PacketsRecv == 0 {
+				unreachable++
+			}
+			if aliveOnly {
+				if s.PacketsRecv > 0 {
+					fmt.Printf("%s is alive\n", s.Addr)
+				} else {
+					fmt.Printf("%s is unreachable\n", s.Addr)
+				}
+				continue
+			}
+			fmt.Printf("%s : xmt/rcv/%%loss = %d/%d/%.0f%%", s.Addr, s.PacketsSent, s.PacketsRecv, s.PacketLoss)
+			if s.PacketsRecv > 0 {
+				fmt.Printf(", min/avg/max = %v/%v/%v", s.MinRtt, s.AvgRtt, s.MaxRtt)
+			}
+			fmt.Println()
+		}
+	}
+	err := multi.Run()
+	if err != nil {
+		fmt.Println("Failed to ping target hosts:", err)
+		os.Exit(2)
+	}
+	// 与fping相同，有目标不可达时返回1
+	if unreachable > 0 {
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,72 @@
+package shlping
+
+import (
+	"encoding/binary"
+	"fmt"
+	"golang.org/x/net/ipv4"
+)
+
+const (
+	// ipv4FlagsOffset IPv4首部中标志和片偏移所在的位置
+	ipv4FlagsOffset = 6
+	// ipv4MoreFragments 标志和片偏移字段中的MF位
+	ipv4MoreFragments = 0x2000
+	// ipOptCopied 选项类型中的复制位，为1的选项需要复制到每一个分片中
+	ipOptCopied = 0x80
+)
+
+// fragmentIPv4 将首部已经填写好的完整数据报b按照mtu分片，分片清除DF位并各自计算校验和。
+// 与Linux相同，之后的分片中不需要复制的选项替换为NOP，所有分片的首部长度相同。
+// 手动填写首部的原始套接字上内核不会分片，超过出接口MTU的数据报直接返回EMSGSIZE；
+// 接收时内核会先重组，不需要自己处理
+func fragmentIPv4(b []byte, mtu int) ([][]byte, error) {
+	hdrLen := int(b[0]&0x0f) << 2
+	chunk := (mtu - hdrLen) &^ 7
+	if chunk <= 0 {
+		return nil, fmt.Errorf("MTU %d too small for %d bytes IPv4 header", mtu, hdrLen)
+	}
+	header := append([]byte(nil), b[:hdrLen]...)
+	var fragments [][]byte
+	for start := 0; start < len(b)-hdrLen; start += chunk {
+		end := min(start+chunk, len(b)-hdrLen)
+		fragment := make([]byte, hdrLen+end-start)
+		copy(fragment, header)
+		copy(fragment[hdrLen:], b[hdrLen+start:hdrLen+end])
+		field := uint16(start / 8)
+		if end < len(b)-hdrLen {
+			field |= ipv4MoreFragments
+		}
+		binary.BigEndian.PutUint16(fragment[2:4], uint16(len(fragment)))
+		binary.BigEndian.PutUint16(fragment[ipv4FlagsOffset:], field)
+		fragment[10], fragment[11] = 0, 0
+		binary.BigEndian.PutUint16(fragment[10:12], internetChecksum(fragment[:hdrLen]))
+		fragments = append(fragments, fragment)
+		if start == 0 {
+			nopUncopiedOptions(header[ipv4.HeaderLen:])
+		}
+	}
+	return fragments, nil
+}
+
+// nopUncopiedOptions 将复制位为0的选项替换为NOP
+func nopUncopiedOptions(opts []byte) {
+	for len(opts) > 0 {
+		switch opts[0] {
+		case ipOptEnd:
+			return
+		case ipOptNop:
+			opts = opts[1:]
+			continue
+		}
+		if len(opts) < 2 || int(opts[1]) < 2 || int(opts[1]) > len(opts) {
+			return
+		}
+		l := int(opts[1])
+		if opts[0]&ipOptCopied == 0 {
+			for i := 0; i < l; i++ {
+				opts[i] = ipOptNop
+			}
+		}
+		opts = opts[l:]
+	}
+}
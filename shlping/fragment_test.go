@@ -0,0 +1,103 @@
+package shlping
+
+import (
+	"bytes"
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv4"
+	"net"
+	"testing"
+)
+
+func TestFragmentIPv4(t *testing.T) {
+	recordRoute, err := buildIPv4Options(true, TimestampNone)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name    string
+		size    int
+		mtu     int
+		options []byte
+		want    int
+	}{
+		{name: "2000 bytes over 1500", size: 2000, mtu: 1500, want: 2},
+		{name: "2000 bytes over 1300", size: 2000, mtu: 1300, want: 2},
+		{name: "largest echo over 576", size: 65535 - ipv4.HeaderLen - icmpEchoHeaderLen, mtu: 576, want: 119},
+		{name: "record route over 1300", size: 3000, mtu: 1300, options: recordRoute, want: 3},
+		{name: "exactly one fragment", size: 1500 - ipv4.HeaderLen - icmpEchoHeaderLen, mtu: 1500, want: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			payload := make([]byte, tt.size)
+			for i := range payload {
+				payload[i] = byte(i)
+			}
+			data := &ICMPv4Data{
+				IPv4Header: &ipv4.Header{
+					ID:      0x4242,
+					TTL:     64,
+					Src:     net.IPv4(10, 1, 0, 1),
+					Dst:     net.IPv4(10, 2, 0, 2),
+					Options: tt.options,
+				},
+				ICMPData: &icmp.Message{Type: ipv4.ICMPTypeEcho, Body: &icmp.Echo{ID: 1, Seq: 2, Data: payload}},
+			}
+			b := make([]byte, data.MarshalLen())
+			n, err := data.MarshalTo(b)
+			if err != nil {
+				t.Fatal(err)
+			}
+			fragments, err := fragmentIPv4(b[:n], tt.mtu)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(fragments) != tt.want {
+				t.Fatalf("%d fragments, want %d", len(fragments), tt.want)
+			}
+			hdrLen := data.IPv4Header.Len
+			var reassembled []byte
+			for i, fragment := range fragments {
+				h := &ipv4.Header{}
+				_, err = parseIPv4Header(h, fragment)
+				if err != nil {
+					t.Fatalf("fragment %d: %v", i, err)
+				}
+				if internetChecksum(fragment[:hdrLen]) != 0 {
+					t.Errorf("fragment %d: bad header checksum", i)
+				}
+				if len(fragment) > tt.mtu || h.Len != hdrLen || h.ID != 0x4242 {
+					t.Errorf("fragment %d: length %d header %d id %#x", i, len(fragment), h.Len, h.ID)
+				}
+				last := i == len(fragments)-1
+				if h.Flags&ipv4.DontFragment != 0 || (h.Flags&ipv4.MoreFragments != 0) == last {
+					t.Errorf("fragment %d: flags %v", i, h.Flags)
+				}
+				if h.FragOff*8 != len(reassembled) {
+					t.Errorf("fragment %d: offset %d, want %d", i, h.FragOff*8, len(reassembled))
+				}
+				if !last && (len(fragment)-hdrLen)%8 != 0 {
+					t.Errorf("fragment %d: payload %d bytes not a multiple of 8", i, len(fragment)-hdrLen)
+				}
+				// 记录路由选项的复制位为0，只出现在第一个分片中
+				if i > 0 && parseIPv4Options(h.Options) != nil {
+					t.Errorf("fragment %d: options %x", i, h.Options)
+				}
+				reassembled = append(reassembled, fragment[hdrLen:]...)
+			}
+			if !bytes.Equal(reassembled, b[hdrLen:n]) {
+				t.Error("reassembled payload differs")
+			}
+			if !bytes.Equal(fragments[0][ipv4.HeaderLen:hdrLen], b[ipv4.HeaderLen:hdrLen]) {
+				t.Error("first fragment options changed")
+			}
+		})
+	}
+}
+
+func TestFragmentIPv4MTUTooSmall(t *testing.T) {
+	b := testIPv4Header(t, nil, nil)
+	_, err := fragmentIPv4(b, ipv4.HeaderLen+7)
+	if err == nil {
+		t.Fatal("fragmenting with no room for payload succeeded")
+	}
+}
@@ -0,0 +1,176 @@
+package shlping
+
+import (
+	"math"
+	"math/bits"
+	"time"
+)
+
+// 直方图按照对数-线性划分桶：每个2的幂区间再均分为histSubBuckets个子桶，
+// 相对误差不超过1/histSubBuckets，桶的数量固定，与样本数无关
+const (
+	histSubBucketBits = 5
+	histSubBuckets    = 1 << histSubBucketBits
+	// histMaxBits 可以区分的最大RTT为2^40ns（约18分钟），更大的值记在最后一个桶中
+	histMaxBits = 40
+	histBuckets = (histMaxBits - histSubBucketBits + 1) * histSubBuckets
+)
+
+// RTTHistogram 流式的RTT直方图，占用固定的内存
+type RTTHistogram struct {
+	counts []uint64
+	total  uint64
+	min    time.Duration
+	max    time.Duration
+}
+
+// HistogramBucket 直方图中的一个桶，包含[Lower, Upper)之间的RTT
+type HistogramBucket struct {
+	Lower time.Duration
+	Upper time.Duration
+	Count uint64
+}
+
+// Record 记录一个RTT
+func (h *RTTHistogram) Record(rtt time.Duration) {
+	if rtt < 0 {
+		rtt = 0
+	}
+	if h.counts == nil {
+		h.counts = make([]uint64, histBuckets)
+	}
+	h.counts[histIndex(uint64(rtt))]++
+	if h.total == 0 || rtt < h.min {
+		h.min = rtt
+	}
+	if rtt > h.max {
+		h.max = rtt
+	}
+	h.total++
+}
+
+// Count 记录的RTT个数
+func (h *RTTHistogram) Count() uint64 {
+	return h.total
+}
+
+// Quantile 返回q（0-1）分位数的RTT，结果为所在桶的上界并且不超过最大值，
+// 误差不超过桶的宽度。没有记录时返回0
+func (h *RTTHistogram) Quantile(q float64) time.Duration {
+	if h.total == 0 {
+		return 0
+	}
+	q = math.Max(0, math.Min(1, q))
+	rank := uint64(math.Ceil(q * float64(h.total)))
+	if rank == 0 {
+		return h.min
+	}
+	var cumulative uint64
+	for i, n := range h.counts {
+		cumulative += n
+		if cumulative >= rank {
+			upper := time.Duration(histLower(i+1) - 1)
+			return max(min(upper, h.max), h.min)
+		}
+	}
+	return h.max
+}
+
+// Buckets 按照RTT从小到大返回所有非空的桶
+func (h *RTTHistogram) Buckets() []HistogramBucket {
+	var buckets []HistogramBucket
+	for i, n := range h.counts {
+		if n == 0 {
+			continue
+		}
+		buckets = append(buckets, HistogramBucket{
+			Lower: time.Duration(histLower(i)),
+			Upper: time.Duration(histLower(i + 1)),
+			Count: n,
+		})
+	}
+	return buckets
+}
+
+// clone 复制直方图，用于统计信息的快照
+func (h *RTTHistogram) clone() *RTTHistogram {
+	c := *h
+	c.counts = append([]uint64(nil), h.counts...)
+	return &c
+}
+
+// histIndex 值v（纳秒）所在的桶。小于histSubBuckets的值每个值一个桶，
+// 之后每个2的幂区间按照最高的histSubBucketBits位划分
+func histIndex(v uint64) int {
+	if v < histSubBuckets {
+		return int(v)
+	}
+	exp := bits.Len64(v) - 1
+	if exp >= histMaxBits {
+		return histBuckets - 1
+	}
+	shift := exp - histSubBucketBits
+	sub := int(v>>shift) - histSubBuckets
+	return (shift+1)*histSubBuckets + sub
+}
+
+// histLower 第i个桶的下界（纳秒）
+func histLower(i int) uint64 {
+	if i < histSubBuckets {
+		return uint64(i)
+	}
+	shift := i/histSubBuckets - 1
+	sub := i % histSubBuckets
+	return uint64(histSubBuckets+sub) << shift
+}
+
+// rttStats 流式计算RTT的最小值、最大值、平均值和标准差（Welford算法）
+type rttStats struct {
+	count int
+	min   time.Duration
+	max   time.Duration
+	mean  float64
+	m2    float64
+}
+
+func (s *rttStats) add(rtt time.Duration) {
+	if s.count == 0 || rtt < s.min {
+		s.min = rtt
+	}
+	if rtt > s.max {
+		s.max = rtt
+	}
+	s.count++
+	delta := float64(rtt) - s.mean
+	s.mean += delta / float64(s.count)
+	s.m2 += delta * (float64(rtt) - s.mean)
+}
+
+func (s *rttStats) avg() time.Duration {
+	return time.Duration(s.mean)
+}
+
+// stdDev 总体标准差
+func (s *rttStats) stdDev() time.Duration {
+	if s.count == 0 {
+		return 0
+	}
+	return time.Duration(math.Sqrt(s.m2 / float64(s.count)))
+}
+
+// jitter 按照RFC 3550的到达间隔抖动估计：J += (|D| - J) / 16，
+// D为相邻两个应答的RTT之差
+type jitter struct {
+	last    time.Duration
+	value   float64
+	samples int
+}
+
+func (j *jitter) add(rtt time.Duration) {
+	if j.samples > 0 {
+		d := math.Abs(float64(rtt - j.last))
+		j.value += (d - j.value) / 16
+	}
+	j.last = rtt
+	j.samples++
+}
@@ -0,0 +1,102 @@
+package shlping
+
+import (
+	"math"
+	"sort"
+	"testing"
+	"time"
+)
+
+func TestRTTHistogramQuantileBounds(t *testing.T) {
+	uniform := make([]time.Duration, 1000)
+	for i := range uniform {
+		uniform[i] = time.Duration(i+1) * time.Microsecond
+	}
+	skewed := []time.Duration{time.Millisecond, time.Millisecond, time.Millisecond, 3 * time.Second}
+	tests := []struct {
+		name    string
+		samples []time.Duration
+	}{
+		{name: "single sample", samples: []time.Duration{1234567 * time.Nanosecond}},
+		{name: "exact small values", samples: []time.Duration{0, 1, 5, 31}},
+		{name: "uniform", samples: uniform},
+		{name: "skewed", samples: skewed},
+		{name: "beyond largest bucket", samples: []time.Duration{time.Hour, time.Hour}},
+	}
+	quantiles := []float64{0, 0.01, 0.5, 0.9, 0.99, 0.999, 1}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var h RTTHistogram
+			for _, rtt := range tt.samples {
+				h.Record(rtt)
+			}
+			sorted := append([]time.Duration(nil), tt.samples...)
+			sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+			for _, q := range quantiles {
+				rank := max(int(math.Ceil(q*float64(len(sorted)))), 1)
+				exact := sorted[rank-1]
+				got := h.Quantile(q)
+				// 结果为所在桶的上界，桶宽不超过下界的1/histSubBuckets
+				if got < exact || got > exact+exact/histSubBuckets {
+					t.Errorf("Quantile(%v) = %v, exact %v", q, got, exact)
+				}
+				if got < sorted[0] || got > sorted[len(sorted)-1] {
+					t.Errorf("Quantile(%v) = %v outside [%v, %v]", q, got, sorted[0], sorted[len(sorted)-1])
+				}
+			}
+			if h.Count() != uint64(len(tt.samples)) {
+				t.Errorf("Count() = %d, want %d", h.Count(), len(tt.samples))
+			}
+		})
+	}
+}
+
+func TestRTTHistogramQuantileEdgeCases(t *testing.T) {
+	var h RTTHistogram
+	if got := h.Quantile(0.5); got != 0 {
+		t.Errorf("empty Quantile(0.5) = %v, want 0", got)
+	}
+	h.Record(-time.Millisecond)
+	h.Record(2 * time.Millisecond)
+	tests := []struct {
+		q    float64
+		want time.Duration
+	}{
+		{q: -1, want: 0},
+		{q: 0, want: 0},
+		{q: 0.5, want: 0},
+		{q: 1, want: 2 * time.Millisecond},
+		{q: 2, want: 2 * time.Millisecond},
+	}
+	for _, tt := range tests {
+		if got := h.Quantile(tt.q); got != tt.want {
+			t.Errorf("Quantile(%v) = %v, want %v", tt.q, got, tt.want)
+		}
+	}
+}
+
+func TestRTTHistogramBuckets(t *testing.T) {
+	var h RTTHistogram
+	samples := []time.Duration{3, 100, 101, time.Millisecond, time.Second}
+	for _, rtt := range samples {
+		h.Record(rtt)
+	}
+	var total uint64
+	var last time.Duration
+	for _, b := range h.Buckets() {
+		if b.Lower >= b.Upper || b.Lower < last {
+			t.Errorf("bucket [%v, %v) out of order", b.Lower, b.Upper)
+		}
+		last = b.Upper
+		total += b.Count
+	}
+	if total != uint64(len(samples)) {
+		t.Errorf("buckets hold %d samples, want %d", total, len(samples))
+	}
+	for _, rtt := range samples {
+		i := histIndex(uint64(rtt))
+		if lower, upper := histLower(i), histLower(i+1); uint64(rtt) < lower || uint64(rtt) >= upper {
+			t.Errorf("%v in bucket [%d, %d)", rtt, lower, upper)
+		}
+	}
+}
@@ -0,0 +1,248 @@
+package shlping
+
+import (
+	"encoding/binary"
+	"fmt"
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+	"net"
+)
+
+// UnreachableError 收到目的不可达差错报文
+type UnreachableError struct {
+	// Router 发出差错报文的路由器或主机
+	Router net.IP
+	// Code 不可达代码，IPv4和IPv6的含义不同
+	Code int
+	// MTU 需要分片时（IPv4代码4）路由器给出的下一跳MTU
+	MTU  int
+	ipv6 bool
+}
+
+func (e *UnreachableError) Error() string {
+	var reason string
+	if e.ipv6 {
+		reason = codeText(unreachableV6Text, e.Code)
+	} else {
+		reason = codeText(unreachableV4Text, e.Code)
+	}
+	if !e.ipv6 && e.Code == 4 {
+		reason = fmt.Sprintf("%s (mtu = %d)", reason, e.MTU)
+	}
+	return fmt.Sprintf("from %s: %s", e.Router, reason)
+}
+
+// TimeExceededError 收到超时差错报文，一般是TTL不够到达目的地址
+type TimeExceededError struct {
+	// Router 发出差错报文的路由器
+	Router net.IP
+	// Code 0为传输中TTL耗尽，1为分片重组超时
+	Code int
+	ipv6 bool
+}
+
+func (e *TimeExceededError) Error() string {
+	text := timeExceededV4Text
+	if e.ipv6 {
+		text = timeExceededV6Text
+	}
+	return fmt.Sprintf("from %s: %s", e.Router, codeText(text, e.Code))
+}
+
+// ParameterProblemError 收到参数问题差错报文
+type ParameterProblemError struct {
+	// Router 发出差错报文的路由器或主机
+	Router net.IP
+	// Code 参数问题代码
+	Code int
+	// Pointer 出错的字节在原始数据报中的偏移
+	Pointer int
+}
+
+func (e *ParameterProblemError) Error() string {
+	return fmt.Sprintf("from %s: parameter problem: pointer = %d", e.Router, e.Pointer)
+}
+
+// RedirectError 收到重定向报文，探测包已经被转发，只是路由器建议使用另一个下一跳
+type RedirectError struct {
+	// Router 发出重定向报文的路由器
+	Router net.IP
+	// Code 重定向代码，只对IPv4有意义
+	Code int
+	// Gateway 建议使用的下一跳
+	Gateway net.IP
+	ipv6    bool
+}
+
+func (e *RedirectError) Error() string {
+	reason := "redirect"
+	if !e.ipv6 {
+		reason = codeText(redirectV4Text, e.Code)
+	}
+	return fmt.Sprintf("from %s: %s (new nexthop: %s)", e.Router, reason, e.Gateway)
+}
+
+var unreachableV4Text = []string{
+	"destination net unreachable",
+	"destination host unreachable",
+	"destination protocol unreachable",
+	"destination port unreachable",
+	"frag needed and DF set",
+	"source route failed",
+	"destination net unknown",
+	"destination host unknown",
+	"source host isolated",
+	"destination net prohibited",
+	"destination host prohibited",
+	"destination net unreachable for type of service",
+	"destination host unreachable for type of service",
+	"packet filtered",
+	"precedence violation",
+	"precedence cutoff",
+}
+
+var unreachableV6Text = []string{
+	"no route",
+	"administratively prohibited",
+	"beyond scope of source address",
+	"address unreachable",
+	"port unreachable",
+	"source address failed ingress/egress policy",
+	"reject route to destination",
+}
+
+var timeExceededV4Text = []string{
+	"time to live exceeded",
+	"frag reassembly time exceeded",
+}
+
+var timeExceededV6Text = []string{
+	"hop limit exceeded",
+	"defragmentation failure",
+}
+
+var redirectV4Text = []string{
+	"redirect network",
+	"redirect host",
+	"redirect type of service and network",
+	"redirect type of service and host",
+}
+
+// codeText 返回代码的说明，未知的代码只给出数值
+func codeText(text []string, code int) string {
+	if code >= 0 && code < len(text) {
+		return text[code]
+	}
+	return fmt.Sprintf("unknown code %d", code)
+}
+
+// redirectGatewayLen IPv4重定向报文中网关地址的长度
+const redirectGatewayLen = 4
+
+// ndpRedirectHeaderLen ICMPv6重定向报文在类型、代码、校验和之后的固定部分：
+// 4字节保留、16字节目标地址、16字节目的地址
+const ndpRedirectHeaderLen = 4 + 2*net.IPv6len
+
+// ndpOptionRedirectedHeader 携带原始数据报的NDP选项类型
+const ndpOptionRedirectedHeader = 4
+
+// decodeICMPError 将差错报文转换为对应的错误，同时返回其中引用的原始数据报。
+// 不是差错报文时返回的错误为nil
+func decodeICMPError(data icmpPacket) ([]byte, error) {
+	// 地址引用接收缓冲区，错误会交给调用方保存
+	router := append(net.IP(nil), data.src()...)
+	msg := data.message()
+	v6 := msg.Type.Protocol() == protocolIPv6ICMP
+	switch body := msg.Body.(type) {
+	case *icmp.DstUnreach:
+		e := &UnreachableError{Router: router, Code: msg.Code, ipv6: v6}
+		if v4, ok := data.(*ICMPv4Data); ok {
+			e.MTU = v4.NextHopMTU()
+		}
+		return body.Data, e
+	case *icmp.TimeExceeded:
+		return body.Data, &TimeExceededError{Router: router, Code: msg.Code, ipv6: v6}
+	case *icmp.ParamProb:
+		return body.Data, &ParameterProblemError{Router: router, Code: msg.Code, Pointer: int(body.Pointer)}
+	case *icmp.RawBody:
+		return decodeRedirect(router, msg.Type, msg.Code, body.Data)
+	}
+	return nil, nil
+}
+
+// decodeRedirect 解析重定向报文，x/net/icmp不解析其报文体
+func decodeRedirect(router net.IP, typ icmp.Type, code int, b []byte) ([]byte, error) {
+	switch typ {
+	case ipv4.ICMPTypeRedirect:
+		if len(b) < redirectGatewayLen {
+			return nil, nil
+		}
+		gateway := net.IP(append([]byte(nil), b[:redirectGatewayLen]...))
+		return b[redirectGatewayLen:], &RedirectError{Router: router, Code: code, Gateway: gateway}
+	case ipv6.ICMPTypeRedirect:
+		if len(b) < ndpRedirectHeaderLen {
+			return nil, nil
+		}
+		gateway := net.IP(append([]byte(nil), b[4:4+net.IPv6len]...))
+		e := &RedirectError{Router: router, Code: code, Gateway: gateway, ipv6: true}
+		// 原始数据报在Redirected Header选项中，选项长度以8字节为单位，数据前有6字节保留
+		for opts := b[ndpRedirectHeaderLen:]; len(opts) >= 8; {
+			optLen := int(opts[1]) * 8
+			if optLen == 0 || optLen > len(opts) {
+				break
+			}
+			if opts[0] == ndpOptionRedirectedHeader {
+				return opts[8:optLen], e
+			}
+			opts = opts[optLen:]
+		}
+		return nil, e
+	}
+	return nil, nil
+}
+
+// quotedEcho 解析差错报文引用的原始数据报，返回原始目的地址和其中的echo请求
+func quotedEcho(quoted []byte, v4 bool) (net.IP, *icmp.Echo, bool) {
+	var dst net.IP
+	var payload []byte
+	proto := protocolICMP
+	if v4 {
+		header, rest, err := parseQuotedIPv4(quoted)
+		if err != nil || header.Protocol != protocolICMP {
+			return nil, nil, false
+		}
+		dst, payload = header.Dst, rest
+	} else {
+		header, err := ipv6.ParseHeader(quoted)
+		// 不处理带有扩展首部的原始数据报
+		if err != nil || header.NextHeader != protocolIPv6ICMP {
+			return nil, nil, false
+		}
+		dst, payload = header.Dst, quoted[ipv6.HeaderLen:]
+		proto = protocolIPv6ICMP
+	}
+	if len(payload) < icmpEchoHeaderLen {
+		return nil, nil, false
+	}
+	msg, err := icmp.ParseMessage(proto, payload)
+	if err != nil {
+		return nil, nil, false
+	}
+	if msg.Type != ipv4.ICMPTypeEcho && msg.Type != ipv6.ICMPTypeEchoRequest {
+		return nil, nil, false
+	}
+	echo, ok := msg.Body.(*icmp.Echo)
+	return dst, echo, ok
+}
+
+// quotedIPv6Header 构造一个只包含地址和上层协议的IPv6首部，
+// 用于将错误队列中的原始报文补全为差错报文引用的数据报
+func quotedIPv6Header(dst net.IP, payloadLen, nextHeader int) []byte {
+	b := make([]byte, ipv6.HeaderLen)
+	b[0] = ipv6.Version << 4
+	binary.BigEndian.PutUint16(b[4:6], uint16(payloadLen))
+	b[6] = byte(nextHeader)
+	copy(b[24:40], dst.To16())
+	return b
+}
@@ -0,0 +1,300 @@
+package shlping
+
+import (
+	"bytes"
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+	"golang.org/x/sys/unix"
+	"net"
+	"testing"
+)
+
+var (
+	testRouter   = net.IPv4(10, 1, 0, 2)
+	testRouterV6 = net.ParseIP("fe80::1")
+	testDstV6    = net.ParseIP("fd02::2")
+)
+
+// testICMPv4Error 生成路由器发来的ICMPv4差错报文并解析，rest为类型、代码和校验和之后的数据
+func testICMPv4Error(t *testing.T, typ ipv4.ICMPType, code int, rest []byte) *ICMPv4Data {
+	b, err := (&ICMPv4Data{
+		IPv4Header: &ipv4.Header{TTL: 64, Src: testRouter, Dst: net.IPv4(10, 1, 0, 1)},
+		ICMPData:   &icmp.Message{Type: typ, Code: code, Body: &icmp.RawBody{Data: rest}},
+	}).Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := &ICMPv4Data{}
+	err = data.Unmarshal(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+// testICMPv6Error 生成路由器发来的ICMPv6差错报文并解析
+func testICMPv6Error(t *testing.T, typ ipv6.ICMPType, code int, rest []byte) *ICMPv6Data {
+	b, err := (&icmp.Message{Type: typ, Code: code, Body: &icmp.RawBody{Data: rest}}).Marshal(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := &ICMPv6Data{IPv6Header: &ipv6.Header{HopLimit: 64, Src: append(net.IP(nil), testRouterV6...)}}
+	err = data.Unmarshal(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+// testQuotedV4 发往10.2.0.2的echo请求（ID和序号为1，24字节负载），截断到n字节，n<0时不截断
+func testQuotedV4(t *testing.T, options []byte, n int) []byte {
+	b := testIPv4Header(t, options, nil)
+	if n >= 0 {
+		b = b[:n]
+	}
+	return b
+}
+
+// testQuotedV6 发往fd02::2的ICMPv6 echo请求，截断到n字节，n<0时不截断
+func testQuotedV6(t *testing.T, typ ipv6.ICMPType, n int) []byte {
+	echo, err := (&icmp.Message{Type: typ, Body: &icmp.Echo{ID: 1, Seq: 1, Data: make([]byte, 24)}}).Marshal(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := append(quotedIPv6Header(testDstV6, len(echo), protocolIPv6ICMP), echo...)
+	if n >= 0 {
+		b = b[:n]
+	}
+	return b
+}
+
+// testNDPRedirect ICMPv6重定向报文体：保留字段、目标地址、目的地址和NDP选项
+func testNDPRedirect(options ...[]byte) []byte {
+	b := make([]byte, 4, ndpRedirectHeaderLen)
+	b = append(b, net.ParseIP("fe80::2")...)
+	b = append(b, testDstV6...)
+	for _, opt := range options {
+		b = append(b, opt...)
+	}
+	return b
+}
+
+// testRedirectedHeader 携带原始数据报的Redirected Header选项，数据补齐到8字节
+func testRedirectedHeader(quoted []byte) []byte {
+	optLen := (8 + len(quoted) + 7) &^ 7
+	b := make([]byte, optLen)
+	b[0], b[1] = ndpOptionRedirectedHeader, byte(optLen/8)
+	copy(b[8:], quoted)
+	return b
+}
+
+func TestDecodeICMPError(t *testing.T) {
+	recordRoute, err := buildIPv4Options(true, TimestampNone)
+	if err != nil {
+		t.Fatal(err)
+	}
+	quoted := testQuotedV4(t, nil, -1)
+	quotedOptions := testQuotedV4(t, recordRoute, -1)
+	truncated := testQuotedV4(t, nil, ipv4.HeaderLen+icmpEchoHeaderLen)
+	quotedV6 := testQuotedV6(t, ipv6.ICMPTypeEchoRequest, -1)
+	truncatedV6 := testQuotedV6(t, ipv6.ICMPTypeEchoRequest, ipv6.HeaderLen+icmpEchoHeaderLen)
+	linkLayer := []byte{1, 1, 0x02, 0, 0, 0, 0, 1}
+
+	tests := []struct {
+		name       string
+		data       icmpPacket
+		wantQuoted []byte
+		// wantErr 期望的错误信息，为空时不是差错报文
+		wantErr string
+	}{
+		{
+			name: "echo reply",
+			data: testICMPv4Error(t, ipv4.ICMPTypeEchoReply, 0, []byte{0, 1, 0, 1}),
+		},
+		{
+			name:       "frag needed",
+			data:       testICMPv4Error(t, ipv4.ICMPTypeDestinationUnreachable, 4, append([]byte{0, 0, 0x05, 0x14}, quoted...)),
+			wantQuoted: quoted,
+			wantErr:    "from 10.1.0.2: frag needed and DF set (mtu = 1300)",
+		},
+		{
+			name:       "port unreachable with truncated quote",
+			data:       testICMPv4Error(t, ipv4.ICMPTypeDestinationUnreachable, 3, append([]byte{0, 0, 0, 0}, truncated...)),
+			wantQuoted: truncated,
+			wantErr:    "from 10.1.0.2: destination port unreachable",
+		},
+		{
+			name:       "unknown unreachable code",
+			data:       testICMPv4Error(t, ipv4.ICMPTypeDestinationUnreachable, 16, append([]byte{0, 0, 0, 0}, truncated...)),
+			wantQuoted: truncated,
+			wantErr:    "from 10.1.0.2: unknown code 16",
+		},
+		{
+			name:       "time exceeded quoting options",
+			data:       testICMPv4Error(t, ipv4.ICMPTypeTimeExceeded, 0, append([]byte{0, 0, 0, 0}, quotedOptions...)),
+			wantQuoted: quotedOptions,
+			wantErr:    "from 10.1.0.2: time to live exceeded",
+		},
+		{
+			name:       "time exceeded without quote",
+			data:       testICMPv4Error(t, ipv4.ICMPTypeTimeExceeded, 1, []byte{0, 0, 0, 0}),
+			wantQuoted: nil,
+			wantErr:    "from 10.1.0.2: frag reassembly time exceeded",
+		},
+		{
+			name:       "parameter problem",
+			data:       testICMPv4Error(t, ipv4.ICMPTypeParameterProblem, 0, append([]byte{20, 0, 0, 0}, quotedOptions...)),
+			wantQuoted: quotedOptions,
+			wantErr:    "from 10.1.0.2: parameter problem: pointer = 20",
+		},
+		{
+			name:       "redirect",
+			data:       testICMPv4Error(t, ipv4.ICMPTypeRedirect, 1, append([]byte{10, 1, 0, 3}, truncated...)),
+			wantQuoted: truncated,
+			wantErr:    "from 10.1.0.2: redirect host (new nexthop: 10.1.0.3)",
+		},
+		{
+			name: "redirect without gateway",
+			data: testICMPv4Error(t, ipv4.ICMPTypeRedirect, 1, []byte{10, 1}),
+		},
+		{
+			name:       "ICMPv6 port unreachable",
+			data:       testICMPv6Error(t, ipv6.ICMPTypeDestinationUnreachable, 4, append([]byte{0, 0, 0, 0}, quotedV6...)),
+			wantQuoted: quotedV6,
+			wantErr:    "from fe80::1: port unreachable",
+		},
+		{
+			name:       "ICMPv6 hop limit exceeded with truncated quote",
+			data:       testICMPv6Error(t, ipv6.ICMPTypeTimeExceeded, 0, append([]byte{0, 0, 0, 0}, truncatedV6...)),
+			wantQuoted: truncatedV6,
+			wantErr:    "from fe80::1: hop limit exceeded",
+		},
+		{
+			name:       "ICMPv6 parameter problem",
+			data:       testICMPv6Error(t, ipv6.ICMPTypeParameterProblem, 1, append([]byte{0, 0, 0, 40}, quotedV6...)),
+			wantQuoted: quotedV6,
+			wantErr:    "from fe80::1: parameter problem: pointer = 40",
+		},
+		{
+			name: "ICMPv6 packet too big",
+			data: testICMPv6Error(t, ipv6.ICMPTypePacketTooBig, 0, append([]byte{0, 0, 0x05, 0x14}, quotedV6...)),
+		},
+		{
+			name:       "ICMPv6 redirect",
+			data:       testICMPv6Error(t, ipv6.ICMPTypeRedirect, 0, testNDPRedirect(linkLayer, testRedirectedHeader(quotedV6))),
+			wantQuoted: quotedV6,
+			wantErr:    "from fe80::1: redirect (new nexthop: fe80::2)",
+		},
+		{
+			name:       "ICMPv6 redirect with padded quote",
+			data:       testICMPv6Error(t, ipv6.ICMPTypeRedirect, 0, testNDPRedirect(testRedirectedHeader(truncatedV6[:ipv6.HeaderLen+4]))),
+			wantQuoted: append(truncatedV6[:ipv6.HeaderLen+4:ipv6.HeaderLen+4], 0, 0, 0, 0),
+			wantErr:    "from fe80::1: redirect (new nexthop: fe80::2)",
+		},
+		{
+			name:    "ICMPv6 redirect without redirected header",
+			data:    testICMPv6Error(t, ipv6.ICMPTypeRedirect, 0, testNDPRedirect(linkLayer)),
+			wantErr: "from fe80::1: redirect (new nexthop: fe80::2)",
+		},
+		{
+			name:    "ICMPv6 redirect with zero option length",
+			data:    testICMPv6Error(t, ipv6.ICMPTypeRedirect, 0, testNDPRedirect([]byte{ndpOptionRedirectedHeader, 0, 0, 0, 0, 0, 0, 0}, testRedirectedHeader(quotedV6))),
+			wantErr: "from fe80::1: redirect (new nexthop: fe80::2)",
+		},
+		{
+			name:    "ICMPv6 redirect with option beyond message",
+			data:    testICMPv6Error(t, ipv6.ICMPTypeRedirect, 0, testNDPRedirect(testRedirectedHeader(quotedV6)[:16])),
+			wantErr: "from fe80::1: redirect (new nexthop: fe80::2)",
+		},
+		{
+			name: "ICMPv6 redirect without addresses",
+			data: testICMPv6Error(t, ipv6.ICMPTypeRedirect, 0, testNDPRedirect()[:ndpRedirectHeaderLen-1]),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			quoted, err := decodeICMPError(tt.data)
+			if !bytes.Equal(quoted, tt.wantQuoted) {
+				t.Errorf("quoted %x, want %x", quoted, tt.wantQuoted)
+			}
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatalf("decodeICMPError() = %v, want nil", err)
+				}
+				return
+			}
+			if err == nil {
+				t.Fatalf("decodeICMPError() = nil, want %q", tt.wantErr)
+			}
+			// 错误中的地址不能引用接收缓冲区
+			src := tt.data.src()
+			copy(src, make(net.IP, len(src)))
+			if v4, ok := tt.data.(*ICMPv4Data); ok {
+				copy(v4.raw, make([]byte, len(v4.raw)))
+			}
+			if err.Error() != tt.wantErr {
+				t.Errorf("decodeICMPError() = %q, want %q", err.Error(), tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestQuotedEcho(t *testing.T) {
+	recordRoute, err := buildIPv4Options(true, TimestampNone)
+	if err != nil {
+		t.Fatal(err)
+	}
+	optionsHeaderLen := int(testQuotedV4(t, recordRoute, -1)[0]&0x0f) << 2
+	reply, err := (&ICMPv4Data{
+		IPv4Header: &ipv4.Header{TTL: 64, Src: net.IPv4(10, 1, 0, 1), Dst: net.IPv4(10, 2, 0, 2)},
+		ICMPData:   &icmp.Message{Type: ipv4.ICMPTypeEchoReply, Body: &icmp.Echo{ID: 1, Seq: 1, Data: make([]byte, 24)}},
+	}).Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	udp := testIPv4Header(t, nil, func(b []byte) { b[9] = unix.IPPROTO_UDP })
+	hopByHop := testQuotedV6(t, ipv6.ICMPTypeEchoRequest, -1)
+	hopByHop[6] = 0
+
+	tests := []struct {
+		name     string
+		quoted   []byte
+		v4       bool
+		wantOK   bool
+		wantDst  net.IP
+		wantData int
+	}{
+		{name: "full quote", quoted: testQuotedV4(t, nil, -1), v4: true, wantOK: true, wantDst: net.IPv4(10, 2, 0, 2), wantData: 24},
+		{name: "IP header and 8 bytes", quoted: testQuotedV4(t, nil, ipv4.HeaderLen+icmpEchoHeaderLen), v4: true, wantOK: true, wantDst: net.IPv4(10, 2, 0, 2)},
+		{name: "options", quoted: testQuotedV4(t, recordRoute, -1), v4: true, wantOK: true, wantDst: net.IPv4(10, 2, 0, 2), wantData: 24},
+		{name: "options and 8 bytes", quoted: testQuotedV4(t, recordRoute, optionsHeaderLen+icmpEchoHeaderLen), v4: true, wantOK: true, wantDst: net.IPv4(10, 2, 0, 2)},
+		{name: "echo header truncated", quoted: testQuotedV4(t, nil, ipv4.HeaderLen+4), v4: true},
+		{name: "options truncated", quoted: testQuotedV4(t, recordRoute, ipv4.HeaderLen+4), v4: true},
+		{name: "IP header truncated", quoted: testQuotedV4(t, nil, ipv4.HeaderLen-1), v4: true},
+		{name: "empty", quoted: nil, v4: true},
+		{name: "echo reply", quoted: reply, v4: true},
+		{name: "UDP", quoted: udp, v4: true},
+		{name: "IPv6 quote as IPv4", quoted: testQuotedV6(t, ipv6.ICMPTypeEchoRequest, -1), v4: true},
+		{name: "ICMPv6 full quote", quoted: testQuotedV6(t, ipv6.ICMPTypeEchoRequest, -1), wantOK: true, wantDst: testDstV6, wantData: 24},
+		{name: "ICMPv6 header and 8 bytes", quoted: testQuotedV6(t, ipv6.ICMPTypeEchoRequest, ipv6.HeaderLen+icmpEchoHeaderLen), wantOK: true, wantDst: testDstV6},
+		{name: "ICMPv6 echo header truncated", quoted: testQuotedV6(t, ipv6.ICMPTypeEchoRequest, ipv6.HeaderLen+4)},
+		{name: "ICMPv6 header truncated", quoted: testQuotedV6(t, ipv6.ICMPTypeEchoRequest, ipv6.HeaderLen-1)},
+		{name: "ICMPv6 echo reply", quoted: testQuotedV6(t, ipv6.ICMPTypeEchoReply, -1)},
+		{name: "ICMPv6 extension header", quoted: hopByHop},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dst, echo, ok := quotedEcho(tt.quoted, tt.v4)
+			if ok != tt.wantOK {
+				t.Fatalf("quotedEcho() ok = %v, want %v", ok, tt.wantOK)
+			}
+			if !ok {
+				return
+			}
+			if !dst.Equal(tt.wantDst) || echo.ID != 1 || echo.Seq != 1 || len(echo.Data) != tt.wantData {
+				t.Errorf("dst %v echo %+v, want %v ID 1 Seq 1 with %d bytes", dst, echo, tt.wantDst, tt.wantData)
+			}
+		})
+	}
+}
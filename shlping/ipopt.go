@@ -0,0 +1,158 @@
+package shlping
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+)
+
+// TimestampOption IPv4时间戳选项的类型
+type TimestampOption int
+
+const (
+	// TimestampNone 不使用时间戳选项
+	TimestampNone TimestampOption = iota
+	// TimestampOnly 每一跳只记录时间戳（ping -T tsonly）
+	TimestampOnly
+	// TimestampAndAddr 每一跳记录地址和时间戳（ping -T tsandaddr）
+	TimestampAndAddr
+)
+
+// IPv4选项类型和长度（RFC 791）
+const (
+	ipOptEnd         = 0
+	ipOptNop         = 1
+	ipOptRecordRoute = 7
+	ipOptTimestamp   = 68
+
+	// ipOptMaxLen IPv4首部最多携带40字节的选项
+	ipOptMaxLen = 40
+	// ipOptRecordRouteLen 记录路由选项的长度，最多记录9个地址
+	ipOptRecordRouteLen = 39
+	// ipOptTimestampPtr 时间戳选项第一条记录的位置，从1开始计数
+	ipOptTimestampPtr = 5
+
+	ipOptTimestampFlagOnly    = 0
+	ipOptTimestampFlagAndAddr = 1
+)
+
+// IPv4Options 应答IP首部中解析出的选项
+type IPv4Options struct {
+	// RecordRoute 记录路由选项中依次记录的地址
+	RecordRoute []net.IP
+	// Timestamps 时间戳选项中依次记录的时间戳
+	Timestamps []IPv4Timestamp
+	// TimestampOverflow 因为选项空间不足没有记录时间戳的跳数
+	TimestampOverflow int
+}
+
+// IPv4Timestamp 时间戳选项中的一条记录
+type IPv4Timestamp struct {
+	// Addr 记录时间戳的地址，TimestampOnly时为nil
+	Addr net.IP
+	// Time UTC零点以来的毫秒数，最高位为1时表示非标准时间
+	Time uint32
+}
+
+// buildIPv4Options 生成探测包携带的IPv4选项，长度补齐到4字节的整数倍
+func buildIPv4Options(recordRoute bool, timestamp TimestampOption) ([]byte, error) {
+	if recordRoute && timestamp != TimestampNone {
+		return nil, errors.New("record route and timestamp options cannot be used together")
+	}
+	var opts []byte
+	switch {
+	case recordRoute:
+		opts = make([]byte, ipOptMaxLen)
+		opts[0] = ipOptRecordRoute
+		opts[1] = ipOptRecordRouteLen
+		opts[2] = 4
+	case timestamp == TimestampOnly:
+		opts = make([]byte, ipOptMaxLen)
+		opts[0] = ipOptTimestamp
+		opts[1] = ipOptMaxLen
+		opts[2] = ipOptTimestampPtr
+		opts[3] = ipOptTimestampFlagOnly
+	case timestamp == TimestampAndAddr:
+		// 地址和时间戳成对记录，最多4对
+		opts = make([]byte, ipOptMaxLen)
+		opts[0] = ipOptTimestamp
+		opts[1] = 36
+		opts[2] = ipOptTimestampPtr
+		opts[3] = ipOptTimestampFlagAndAddr
+	case timestamp != TimestampNone:
+		return nil, errors.New("unknown timestamp option")
+	}
+	return opts, nil
+}
+
+// parseIPv4Options 解析IP首部中的选项，没有可识别的选项时返回nil
+func parseIPv4Options(b []byte) *IPv4Options {
+	var opts *IPv4Options
+	for len(b) > 0 {
+		switch b[0] {
+		case ipOptEnd:
+			return opts
+		case ipOptNop:
+			b = b[1:]
+			continue
+		}
+		if len(b) < 2 || int(b[1]) < 2 || int(b[1]) > len(b) {
+			return opts
+		}
+		opt := b[:b[1]]
+		b = b[b[1]:]
+		switch opt[0] {
+		case ipOptRecordRoute:
+			if opts == nil {
+				opts = &IPv4Options{}
+			}
+			opts.RecordRoute = parseRecordRoute(opt)
+		case ipOptTimestamp:
+			if opts == nil {
+				opts = &IPv4Options{}
+			}
+			opts.Timestamps, opts.TimestampOverflow = parseTimestamp(opt)
+		}
+	}
+	return opts
+}
+
+// parseRecordRoute 解析记录路由选项，指针之前的部分为已经记录的地址
+func parseRecordRoute(opt []byte) []net.IP {
+	if len(opt) < 3 {
+		return nil
+	}
+	end := min(int(opt[2])-1, len(opt))
+	var addrs []net.IP
+	for i := 3; i+net.IPv4len <= end; i += net.IPv4len {
+		addrs = append(addrs, net.IP(append([]byte(nil), opt[i:i+net.IPv4len]...)))
+	}
+	return addrs
+}
+
+// parseTimestamp 解析时间戳选项，返回已经记录的时间戳和溢出计数
+func parseTimestamp(opt []byte) ([]IPv4Timestamp, int) {
+	if len(opt) < 4 {
+		return nil, 0
+	}
+	end := min(int(opt[2])-1, len(opt))
+	overflow, flag := int(opt[3]>>4), opt[3]&0x0f
+	var stamps []IPv4Timestamp
+	for i := 4; i < end; {
+		var stamp IPv4Timestamp
+		if flag != ipOptTimestampFlagOnly {
+			if i+net.IPv4len > end {
+				break
+			}
+			stamp.Addr = net.IP(append([]byte(nil), opt[i:i+net.IPv4len]...))
+			i += net.IPv4len
+		}
+		if i+4 > end {
+			break
+		}
+		stamp.Time = binary.BigEndian.Uint32(opt[i : i+4])
+		i += 4
+		stamps = append(stamps, stamp)
+	}
+	return stamps, overflow
+}
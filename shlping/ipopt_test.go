@@ -0,0 +1,112 @@
+package shlping
+
+import (
+	"net"
+	"reflect"
+	"testing"
+)
+
+func TestParseIPv4Options(t *testing.T) {
+	a1, a2, a3 := net.IP{10, 1, 0, 2}, net.IP{10, 2, 0, 1}, net.IP{10, 2, 0, 2}
+	// rr 记录了a1和a2的记录路由选项，指针指向第三个地址
+	rr := []byte{ipOptRecordRoute, 11, 12, 10, 1, 0, 2, 10, 2, 0, 1}
+	tests := []struct {
+		name string
+		b    []byte
+		want *IPv4Options
+	}{
+		{name: "empty", b: nil, want: nil},
+		{name: "end of options", b: []byte{ipOptEnd, ipOptRecordRoute, 3, 4}, want: nil},
+		{name: "padding only", b: []byte{ipOptNop, ipOptNop, ipOptNop, ipOptNop}, want: nil},
+		{name: "record route", b: rr, want: &IPv4Options{RecordRoute: []net.IP{a1, a2}}},
+		{name: "record route after nop", b: append([]byte{ipOptNop}, rr...), want: &IPv4Options{RecordRoute: []net.IP{a1, a2}}},
+		{
+			name: "record route full",
+			b:    []byte{ipOptRecordRoute, 15, 16, 10, 1, 0, 2, 10, 2, 0, 1, 10, 2, 0, 2},
+			want: &IPv4Options{RecordRoute: []net.IP{a1, a2, a3}},
+		},
+		{
+			name: "record route pointer beyond length",
+			b:    []byte{ipOptRecordRoute, 11, 40, 10, 1, 0, 2, 10, 2, 0, 1},
+			want: &IPv4Options{RecordRoute: []net.IP{a1, a2}},
+		},
+		{name: "record route nothing recorded", b: []byte{ipOptRecordRoute, 7, 4, 0, 0, 0, 0}, want: &IPv4Options{}},
+		{name: "record route without pointer", b: []byte{ipOptRecordRoute, 2}, want: &IPv4Options{}},
+		{name: "record route truncated", b: rr[:8], want: nil},
+		{name: "length below 2", b: []byte{ipOptRecordRoute, 1, 4}, want: nil},
+		{name: "length byte missing", b: []byte{ipOptRecordRoute}, want: nil},
+		{
+			name: "timestamp only",
+			b:    []byte{ipOptTimestamp, 12, 13, ipOptTimestampFlagOnly, 0, 0, 0, 1, 0, 0, 0, 2},
+			want: &IPv4Options{Timestamps: []IPv4Timestamp{{Time: 1}, {Time: 2}}},
+		},
+		{
+			name: "timestamp overflow",
+			b:    []byte{ipOptTimestamp, 8, 9, 3<<4 | ipOptTimestampFlagOnly, 0, 0, 0, 1},
+			want: &IPv4Options{Timestamps: []IPv4Timestamp{{Time: 1}}, TimestampOverflow: 3},
+		},
+		{
+			name: "timestamp only partial record",
+			b:    []byte{ipOptTimestamp, 10, 11, ipOptTimestampFlagOnly, 0, 0, 0, 1, 0, 0},
+			want: &IPv4Options{Timestamps: []IPv4Timestamp{{Time: 1}}},
+		},
+		{
+			name: "timestamp and address",
+			b:    []byte{ipOptTimestamp, 20, 21, ipOptTimestampFlagAndAddr, 10, 1, 0, 2, 0, 0, 0, 1, 10, 2, 0, 1, 0, 0, 0, 2},
+			want: &IPv4Options{Timestamps: []IPv4Timestamp{{Addr: a1, Time: 1}, {Addr: a2, Time: 2}}},
+		},
+		{
+			name: "timestamp and address missing time",
+			b:    []byte{ipOptTimestamp, 16, 17, ipOptTimestampFlagAndAddr, 10, 1, 0, 2, 0, 0, 0, 1, 10, 2, 0, 1},
+			want: &IPv4Options{Timestamps: []IPv4Timestamp{{Addr: a1, Time: 1}}},
+		},
+		{
+			name: "timestamp and address partial address",
+			b:    []byte{ipOptTimestamp, 14, 15, ipOptTimestampFlagAndAddr, 10, 1, 0, 2, 0, 0, 0, 1, 10, 2},
+			want: &IPv4Options{Timestamps: []IPv4Timestamp{{Addr: a1, Time: 1}}},
+		},
+		{name: "timestamp without flags", b: []byte{ipOptTimestamp, 3, 5}, want: &IPv4Options{}},
+		{name: "timestamp truncated", b: []byte{ipOptTimestamp, 12, 13, ipOptTimestampFlagOnly, 0, 0, 0, 1}, want: nil},
+		{name: "unknown option", b: []byte{0x94, 4, 0, 0}, want: nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := parseIPv4Options(tt.b)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseIPv4Options(%x) = %+v, want %+v", tt.b, got, tt.want)
+			}
+		})
+	}
+}
+
+// 构造的选项在路由器记录之前解析不出任何地址和时间戳
+func TestBuildIPv4Options(t *testing.T) {
+	tests := []struct {
+		name        string
+		recordRoute bool
+		timestamp   TimestampOption
+		wantLen     int
+		wantErr     bool
+	}{
+		{name: "none", wantLen: 0},
+		{name: "record route", recordRoute: true, wantLen: ipOptMaxLen},
+		{name: "timestamp only", timestamp: TimestampOnly, wantLen: ipOptMaxLen},
+		{name: "timestamp and address", timestamp: TimestampAndAddr, wantLen: ipOptMaxLen},
+		{name: "both", recordRoute: true, timestamp: TimestampOnly, wantErr: true},
+		{name: "unknown timestamp", timestamp: TimestampOption(9), wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts, err := buildIPv4Options(tt.recordRoute, tt.timestamp)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, want error %v", err, tt.wantErr)
+			}
+			if len(opts) != tt.wantLen || len(opts)%4 != 0 {
+				t.Fatalf("len = %d, want %d", len(opts), tt.wantLen)
+			}
+			if parsed := parseIPv4Options(opts); len(opts) > 0 && (parsed == nil || len(parsed.RecordRoute) != 0 || len(parsed.Timestamps) != 0) {
+				t.Errorf("parseIPv4Options = %+v", parsed)
+			}
+		})
+	}
+}
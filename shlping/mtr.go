@@ -0,0 +1,379 @@
+package shlping
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+// HopStats 路径上某一跳的统计信息
+type HopStats struct {
+	// TTL 该跳的TTL
+	TTL int
+	// Addr 最近一次应答的地址，为nil表示还没有收到应答
+	Addr *net.IPAddr
+	// Addrs 该跳出现过的所有地址，多于一个说明存在等价多路径或者路径发生过变化
+	Addrs []*net.IPAddr
+	// Sent 已经有结果（应答或者超时）的探测次数
+	Sent int
+	// Recv 收到应答的次数
+	Recv int
+	// Loss 丢包率，百分比
+	Loss float64
+	// Last 最近一次的RTT
+	Last time.Duration
+	// Avg 平均RTT
+	Avg time.Duration
+	// Best 最小RTT
+	Best time.Duration
+	// Worst 最大RTT
+	Worst time.Duration
+	// StdDev RTT的标准差
+	StdDev time.Duration
+}
+
+// MarshalJSON 与mtr --json相同，时间以毫秒为单位输出
+func (h *HopStats) MarshalJSON() ([]byte, error) {
+	var addrs []string
+	for _, addr := range h.Addrs {
+		addrs = append(addrs, addr.String())
+	}
+	host := "???"
+	if h.Addr != nil {
+		host = h.Addr.String()
+	}
+	return json.Marshal(struct {
+		TTL    int      `json:"count"`
+		Host   string   `json:"host"`
+		Addrs  []string `json:"addrs,omitempty"`
+		Loss   float64  `json:"Loss%"`
+		Sent   int      `json:"Snt"`
+		Last   float64  `json:"Last"`
+		Avg    float64  `json:"Avg"`
+		Best   float64  `json:"Best"`
+		Worst  float64  `json:"Wrst"`
+		StdDev float64  `json:"StDev"`
+	}{h.TTL, host, addrs, h.Loss, h.Sent, ms(h.Last), ms(h.Avg), ms(h.Best), ms(h.Worst), ms(h.StdDev)})
+}
+
+func ms(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+// PathChange 某一跳出现了新的应答地址
+type PathChange struct {
+	// TTL 发生变化的跳
+	TTL int
+	// Old 之前的地址
+	Old *net.IPAddr
+	// New 新的地址
+	New *net.IPAddr
+	// At 发现变化的时间
+	At time.Time
+}
+
+// PathReport 路径监控的报告
+type PathReport struct {
+	// Target 目的地址
+	Target string `json:"dst"`
+	// Source 源地址
+	Source string `json:"src"`
+	// Start 开始时间
+	Start time.Time `json:"start"`
+	// Rounds 已经完成的探测轮数
+	Rounds int `json:"tests"`
+	// Hops 每一跳的统计信息，到目的地址为止
+	Hops []*HopStats `json:"hubs"`
+	// Changes 发现的路径变化
+	Changes []*PathChange `json:"-"`
+}
+
+// hopState 一跳的累计状态，RTT流式统计，内存占用固定
+type hopState struct {
+	stats HopStats
+	rtts  rttStats
+}
+
+// mtrProbe 还未收到应答的探测包
+type mtrProbe struct {
+	ttl    int
+	sentAt time.Time
+}
+
+// PathMonitor 持续探测路径上的每一跳，统计每一跳的丢包和RTT并发现路径变化，相当于mtr。
+// 探测包的配置（FirstTTL、MaxTTL、ProbeType、Port、Size、SourceAddr以及作为单个探测
+// 超时时间的Timeout）与Tracer相同
+type PathMonitor struct {
+	*Tracer
+	// Interval 两轮探测的间隔，默认为1秒
+	Interval time.Duration
+	// Count 探测轮数，-1表示一直运行直到Stop，其他值必须大于0
+	Count int
+
+	// OnUpdate 每轮探测发出前触发，参数为当前的报告
+	OnUpdate func(*PathReport)
+	// OnPathChange 某一跳出现了之前没有应答过的地址时触发，等价多路径上已知地址之间的交替不触发
+	OnPathChange func(*PathChange)
+
+	hops []*hopState
+	// maxHop 目的地址应答的最小TTL，之后的跳不再探测
+	maxHop  int
+	pending map[int]*mtrProbe
+	start   time.Time
+	rounds  int
+	changes []*PathChange
+	lock    sync.Mutex
+	done    chan struct{}
+}
+
+// NewPathMonitor 新建一个PathMonitor
+func NewPathMonitor(addr string) (*PathMonitor, error) {
+	tracer, err := NewTracer(addr)
+	if err != nil {
+		return nil, err
+	}
+	tracer.ProbeType = ProbeICMP
+	tracer.Timeout = 2 * time.Second
+	return &PathMonitor{
+		Tracer:   tracer,
+		Interval: time.Second,
+		Count:    -1,
+	}, nil
+}
+
+// Run 开始监控，会阻塞，直到完成Count轮或者调用Stop
+func (m *PathMonitor) Run() error {
+	return m.RunWithContext(context.Background())
+}
+
+// RunWithContext 与Run相同，ctx被取消时停止并返回ctx.Err()
+func (m *PathMonitor) RunWithContext(ctx context.Context) error {
+	done, endRun := startRun(&m.lock, &m.done)
+	defer endRun()
+	var err error
+	if m.TargetIpaddr == nil {
+		err = m.Resolve()
+	}
+	if err != nil {
+		return err
+	}
+	err = m.checkProbeType()
+	if err != nil {
+		return err
+	}
+	err = m.checkTTL()
+	if err != nil {
+		return err
+	}
+	if m.Interval <= 0 {
+		return fmt.Errorf("invalid interval %v", m.Interval)
+	}
+	if m.Count == 0 || m.Count < -1 {
+		return fmt.Errorf("invalid count %d", m.Count)
+	}
+	m.SourceIpAddr, err = selectSource(m.network, m.SourceAddr, m.TargetIpaddr, 0)
+	if err != nil {
+		return err
+	}
+	conn, err := m.listen()
+	if err != nil {
+		return err
+	}
+	defer conn.close()
+	r, err := newReceiver()
+	if err != nil {
+		return err
+	}
+	r.start(conn)
+	defer r.stop()
+
+	m.lock.Lock()
+	m.hops = nil
+	for ttl := m.FirstTTL; ttl <= m.MaxTTL; ttl++ {
+		m.hops = append(m.hops, &hopState{stats: HopStats{TTL: ttl}})
+	}
+	m.maxHop = m.MaxTTL
+	m.pending = map[int]*mtrProbe{}
+	m.start = time.Now()
+	m.rounds = 0
+	m.changes = nil
+	m.lock.Unlock()
+
+	interval := time.NewTicker(m.Interval)
+	defer interval.Stop()
+	// last 最后一轮发出后等待应答
+	var last <-chan time.Time
+
+	err = m.sendRound(conn)
+	if err != nil {
+		return err
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-done:
+			return nil
+		case err = <-r.errs:
+			return err
+		case recv := <-r.recv:
+			m.handleReply(recv)
+		case <-last:
+			m.expire(time.Now().Add(m.Timeout))
+			return nil
+		case now := <-interval.C:
+			m.expire(now)
+			if handler := m.OnUpdate; handler != nil {
+				handler(m.Report())
+			}
+			if m.Count > 0 && m.rounds >= m.Count {
+				interval.Stop()
+				last = time.After(m.Timeout)
+				continue
+			}
+			err = m.sendRound(conn)
+			if err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// Stop 停止正在运行的Run，可以在任意协程中多次调用，没有在运行时什么也不做
+func (m *PathMonitor) Stop() {
+	stopRun(&m.lock, &m.done)
+}
+
+// Report 返回当前的报告，Run执行过程中也可以调用
+func (m *PathMonitor) Report() *PathReport {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	report := &PathReport{
+		Start:   m.start,
+		Rounds:  m.rounds,
+		Changes: append([]*PathChange(nil), m.changes...),
+	}
+	if m.TargetIpaddr != nil {
+		report.Target = m.TargetIpaddr.String()
+	}
+	if m.SourceIpAddr != nil {
+		report.Source = m.SourceIpAddr.String()
+	}
+	for _, hop := range m.hops {
+		if hop.stats.TTL > m.maxHop {
+			break
+		}
+		stats := hop.stats
+		stats.Addrs = append([]*net.IPAddr(nil), hop.stats.Addrs...)
+		report.Hops = append(report.Hops, &stats)
+	}
+	return report
+}
+
+// sendRound 向每一跳发送一个探测包
+func (m *PathMonitor) sendRound(conn *icmpConn) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	now := time.Now()
+	for _, hop := range m.hops {
+		ttl := hop.stats.TTL
+		if ttl > m.maxHop {
+			break
+		}
+		seq := m.nextSequence()
+		err := m.sendProbe(conn, ttl, seq, m.Size, 0)
+		if err != nil {
+			return err
+		}
+		m.pending[seq] = &mtrProbe{ttl: ttl, sentAt: now}
+	}
+	m.rounds++
+	return nil
+}
+
+// handleReply 处理一个应答，更新对应跳的统计
+func (m *PathMonitor) handleReply(recv *recvPacket) {
+	seq, ok := m.matchProbe(recv.data)
+	if !ok {
+		return
+	}
+
+	m.lock.Lock()
+	probe, ok := m.pending[seq]
+	if !ok {
+		m.lock.Unlock()
+		return
+	}
+	delete(m.pending, seq)
+	hop := m.hops[probe.ttl-m.FirstTTL]
+	addr := &net.IPAddr{IP: append(net.IP(nil), recv.data.src()...)}
+	change := m.updateHop(hop, addr, recv.receivedAt.Sub(probe.sentAt), recv.receivedAt)
+	if addr.IP.Equal(m.TargetIpaddr.IP) && probe.ttl < m.maxHop {
+		m.maxHop = probe.ttl
+	}
+	m.lock.Unlock()
+
+	if change != nil {
+		if handler := m.OnPathChange; handler != nil {
+			handler(change)
+		}
+	}
+}
+
+// updateHop 记录一次应答，地址变化时返回PathChange。调用方需持有m.lock
+func (m *PathMonitor) updateHop(hop *hopState, addr *net.IPAddr, rtt time.Duration, now time.Time) *PathChange {
+	s := &hop.stats
+	s.Sent++
+	s.Recv++
+	s.Last = rtt
+	hop.rtts.add(rtt)
+	s.Best = hop.rtts.min
+	s.Worst = hop.rtts.max
+	s.Avg = hop.rtts.avg()
+	s.StdDev = hop.rtts.stdDev()
+	s.Loss = float64(s.Sent-s.Recv) / float64(s.Sent) * 100
+
+	known := false
+	for _, a := range s.Addrs {
+		if a.IP.Equal(addr.IP) {
+			known = true
+			break
+		}
+	}
+	// 等价多路径上应答地址会在几个已知地址之间交替，只有出现新地址时才认为路径发生了变化
+	var change *PathChange
+	if !known {
+		if s.Addr != nil {
+			change = &PathChange{TTL: s.TTL, Old: s.Addr, New: addr, At: now}
+			m.changes = append(m.changes, change)
+			// 路径变化后重新寻找目的地址所在的跳
+			if s.TTL <= m.maxHop {
+				m.maxHop = m.MaxTTL
+			}
+		}
+		s.Addrs = append(s.Addrs, addr)
+	}
+	s.Addr = addr
+	return change
+}
+
+// expire 将在now之前超过Timeout仍未应答的探测记为丢包
+func (m *PathMonitor) expire(now time.Time) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	for seq, probe := range m.pending {
+		if now.Sub(probe.sentAt) < m.Timeout {
+			continue
+		}
+		delete(m.pending, seq)
+		hop := m.hops[probe.ttl-m.FirstTTL]
+		hop.stats.Sent++
+		hop.stats.Loss = float64(hop.stats.Sent-hop.stats.Recv) / float64(hop.stats.Sent) * 100
+	}
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"github.com/Senhnn/go_tool/shlping"
+	"os"
+	"os/signal"
+	"time"
+)
+
+var usage = `
+用法:
+    mtr [-c count] [-i interval] [-m max_ttl] [-u] [-j] host
+样例:
+	-c：探测轮数，不指定时一直运行直到Ctrl-C
+	-i：两轮探测的间隔（单位为s，默认1）
+	-m：最大TTL（默认30）
+	-u：使用UDP探测，默认使用ICMP echo
+	-j：不刷新表格，结束后输出JSON报告
+    # 持续监控
+    mtr www.google.com
+
+    # 探测10轮后输出JSON报告
+    mtr -c 10 -j www.google.com
+`
+
+func main() {
+	count := flag.Int("c", -1, "")
+	interval := flag.Float64("i", 1, "")
+	max := flag.Int("m", 30, "")
+	useUDP := flag.Bool("u", false, "")
+	jsonReport := flag.Bool("j", false, "")
+
+	flag.Usage = func() {
+		fmt.Print(usage)
+	}
+	flag.Parse()
+
+	if flag.NArg() == 0 {
+		flag.Usage()
+		return
+	}
+
+	host := flag.Arg(0)
+	monitor, err := shlping.NewPathMonitor(host)
+	if err != nil {
+		fmt.Println("ERROR:", err)
+		return
+	}
+	monitor.Count = *count
+	monitor.Interval = time.Duration(*interval * float64(time.Second))
+	monitor.MaxTTL = *max
+	if *useUDP {
+		monitor.ProbeType = shlping.ProbeUDP
+	}
+	if !*jsonReport {
+		monitor.OnUpdate = func(report *shlping.PathReport) {
+			// 清屏后重新输出表格
+			fmt.Print("\033[H\033[2J")
+			printReport(host, report)
+		}
+	}
+
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer cancel()
+	err = monitor.RunWithContext(ctx)
+	if err != nil && err != context.Canceled {
+		fmt.Println("Failed to trace target host:", err)
+		os.Exit(1)
+	}
+
+	report := monitor.Report()
+	if *jsonReport {
+		b, err := json.MarshalIndent(report, "", "  ")
+		if err != nil {
+			fmt.Println("ERROR:", err)
+			os.Exit(1)
+		}
+		fmt.Println(string(b))
+		return
+	}
+	fmt.Print("\033[H\033[2J")
+	printReport(host, report)
+}
+
+func printReport(host string, report *shlping.PathReport) {
+	fmt.Printf("Start: %s\n", report.Start.Format(time.RFC3339))
+	fmt.Printf("HOST: %s -> %s (%s)\n", report.Source, host, report.Target)
+	fmt.Printf("%-32s %6s %5s %7s %7s %7s %7s %7s\n", "", "Loss%", "Snt", "Last", "Avg", "Best", "Wrst", "StDev")
+	for _, hop := range report.Hops {
+		addr := "???"
+		if hop.Addr != nil {
+			addr = hop.Addr.String()
+		}
+		fmt.Printf("%3d. %-27s %5.1f%% %5d %7.1f %7.1f %7.1f %7.1f %7.1f\n",
+			hop.TTL, addr, hop.Loss, hop.Sent, ms(hop.Last), ms(hop.Avg), ms(hop.Best), ms(hop.Worst), ms(hop.StdDev))
+		// 同一跳出现多个地址时依次列出
+		for _, other := range hop.Addrs {
+			if hop.Addr != nil && !other.IP.Equal(hop.Addr.IP) {
+				fmt.Printf("     %s\n", other)
+			}
+		}
+	}
+	for _, change := range report.Changes {
+		fmt.Printf("path change at hop %d: %s -> %s (%s)\n",
+			change.TTL, change.Old, change.New, change.At.Format(time.TimeOnly))
+	}
+}
+
+func ms(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
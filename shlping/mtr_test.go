@@ -0,0 +1,70 @@
+package shlping
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestPathMonitorUpdateHop(t *testing.T) {
+	a, b, c := net.IPv4(10, 0, 0, 1), net.IPv4(10, 0, 0, 2), net.IPv4(10, 0, 0, 3)
+	tests := []struct {
+		name        string
+		addrs       []net.IP
+		wantChanges int
+		wantAddrs   int
+	}{
+		{name: "stable", addrs: []net.IP{a, a, a}, wantChanges: 0, wantAddrs: 1},
+		{name: "route change", addrs: []net.IP{a, a, b, b}, wantChanges: 1, wantAddrs: 2},
+		{name: "ECMP alternation", addrs: []net.IP{a, b, a, b, a, b}, wantChanges: 1, wantAddrs: 2},
+		{name: "third path", addrs: []net.IP{a, b, a, c, b, c}, wantChanges: 2, wantAddrs: 3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := &PathMonitor{Tracer: &Tracer{FirstTTL: 1, MaxTTL: 30}, maxHop: 2}
+			hop := &hopState{stats: HopStats{TTL: 1}}
+			changes := 0
+			for _, addr := range tt.addrs {
+				if m.updateHop(hop, &net.IPAddr{IP: addr}, time.Millisecond, time.Now()) != nil {
+					changes++
+				}
+			}
+			if changes != tt.wantChanges || len(m.changes) != tt.wantChanges {
+				t.Errorf("%d changes, want %d", changes, tt.wantChanges)
+			}
+			if len(hop.stats.Addrs) != tt.wantAddrs || !hop.stats.Addr.IP.Equal(tt.addrs[len(tt.addrs)-1]) {
+				t.Errorf("addrs %v last %v", hop.stats.Addrs, hop.stats.Addr)
+			}
+			if tt.wantChanges == 0 && m.maxHop != 2 {
+				t.Errorf("maxHop reset to %d without a path change", m.maxHop)
+			}
+		})
+	}
+}
+
+func TestPathMonitorRejectsInvalidConfig(t *testing.T) {
+	tests := []struct {
+		name   string
+		modify func(m *PathMonitor)
+	}{
+		{name: "zero interval", modify: func(m *PathMonitor) { m.Interval = 0 }},
+		{name: "negative interval", modify: func(m *PathMonitor) { m.Interval = -time.Second }},
+		{name: "zero count", modify: func(m *PathMonitor) { m.Count = 0 }},
+		{name: "negative count", modify: func(m *PathMonitor) { m.Count = -2 }},
+		{name: "zero first TTL", modify: func(m *PathMonitor) { m.FirstTTL = 0 }},
+		{name: "max TTL over 255", modify: func(m *PathMonitor) { m.MaxTTL = 256 }},
+		{name: "first TTL over max TTL", modify: func(m *PathMonitor) { m.FirstTTL, m.MaxTTL = 10, 5 }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m, err := NewPathMonitor("127.0.0.1")
+			if err != nil {
+				t.Fatal(err)
+			}
+			tt.modify(m)
+			if err := m.Run(); err == nil {
+				t.Fatal("Run accepted an invalid configuration")
+			}
+		})
+	}
+}
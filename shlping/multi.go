@@ -0,0 +1,418 @@
+package shlping
+
+import (
+	"container/heap"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/google/uuid"
+	"golang.org/x/net/icmp"
+	"math"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+)
+
+// MultiPinger 同时ping多个目标。每个协议族只使用一个套接字和一个接收协程，
+// 所有目标的发包由Run所在的协程按照各自的Interval调度，
+// 应答按照ID、序号和负载中的tracker分发给对应的目标
+type MultiPinger struct {
+	// Timeout 总的运行时间，超过后所有目标停止
+	Timeout time.Duration
+	// Wait 目标发完Count个包后等待剩余应答的时间
+	Wait time.Duration
+	// TTL AddTarget时作为目标的TTL，之后可以通过返回的Pinger为每个目标单独设置
+	TTL int
+
+	// OnSetup 套接字建立后触发
+	OnSetup func()
+	// OnFinish Run结束时触发，参数为所有目标的统计信息
+	OnFinish func([]*Statistics)
+
+	targets []*multiTarget
+	// trackers tracker到目标的映射，用于分发应答
+	trackers map[uuid.UUID]*multiTarget
+	// queue 按照下次发包时间排序的目标
+	queue targetQueue
+
+	id   int
+	lock sync.Mutex
+	done chan struct{}
+	// network 为"ip","ip4","ip6"
+	network string
+	// protocol 为"icmp","udp"，"udp"表示使用非特权的ICMP数据报套接字
+	protocol string
+}
+
+// multiTarget MultiPinger中的一个目标
+type multiTarget struct {
+	pinger *Pinger
+	conn   *icmpConn
+	// next 下次发包或者检查是否结束的时间
+	next time.Time
+	// finished 目标是否已经结束
+	finished bool
+	// index 在queue中的下标，不在队列中时为-1
+	index int
+}
+
+// NewMultiPinger 新建一个MultiPinger
+func NewMultiPinger() *MultiPinger {
+	r := rand.New(rand.NewSource(getSeed()))
+	return &MultiPinger{
+		Timeout:  time.Duration(math.MaxInt64),
+		Wait:     time.Second,
+		TTL:      defaultTTL,
+		trackers: map[uuid.UUID]*multiTarget{},
+		id:       r.Intn(math.MaxUint16),
+		network:  "ip",
+		protocol: "icmp",
+	}
+}
+
+// SetPrivileged 设置是否使用特权模式，含义与Pinger.SetPrivileged相同
+func (m *MultiPinger) SetPrivileged(privileged bool) {
+	if privileged {
+		m.protocol = "icmp"
+	} else {
+		m.protocol = "udp"
+	}
+}
+
+// Privileged 是否为特权模式
+func (m *MultiPinger) Privileged() bool {
+	return m.protocol == "icmp"
+}
+
+// SetNetwork 设置之后添加的目标解析地址时使用的网络，含义与Pinger.SetNetwork相同
+func (m *MultiPinger) SetNetwork(n string) {
+	switch n {
+	case "ip4", "ip6":
+		m.network = n
+	default:
+		m.network = "ip"
+	}
+}
+
+// AddTarget 添加一个目标并解析其地址。返回的Pinger用于设置该目标的Interval、Count、
+// Timeout、Size、SourceAddr以及回调，结束后通过它的Statistics获取结果。
+// 返回的Pinger由MultiPinger驱动，不能再调用它的Run
+func (m *MultiPinger) AddTarget(addr string) (*Pinger, error) {
+	p := newPinger(addr)
+	p.network = m.network
+	p.TTL = m.TTL
+	err := p.Resolve()
+	if err != nil {
+		return nil, err
+	}
+	m.targets = append(m.targets, &multiTarget{pinger: p})
+	return p, nil
+}
+
+// Targets 返回所有目标
+func (m *MultiPinger) Targets() []*Pinger {
+	targets := make([]*Pinger, 0, len(m.targets))
+	for _, t := range m.targets {
+		targets = append(targets, t.pinger)
+	}
+	return targets
+}
+
+// Statistics 返回所有目标当前的统计信息，Run执行过程中也可以调用
+func (m *MultiPinger) Statistics() []*Statistics {
+	stats := make([]*Statistics, 0, len(m.targets))
+	for _, t := range m.targets {
+		stats = append(stats, t.pinger.Statistics())
+	}
+	return stats
+}
+
+// Run 开始ping所有目标，会阻塞，直到所有目标结束、超时或者调用Stop
+func (m *MultiPinger) Run() error {
+	return m.RunWithContext(context.Background())
+}
+
+// RunWithContext 与Run相同，ctx被取消时停止并返回ctx.Err()
+func (m *MultiPinger) RunWithContext(ctx context.Context) error {
+	done, endRun := startRun(&m.lock, &m.done)
+	defer endRun()
+	if len(m.targets) == 0 {
+		return errors.New("no targets")
+	}
+	conns, err := m.listen()
+	if err != nil {
+		return err
+	}
+	defer func() {
+		for _, conn := range conns {
+			conn.close()
+		}
+	}()
+	r, err := newReceiver()
+	if err != nil {
+		return err
+	}
+
+	if handler := m.OnSetup; handler != nil {
+		handler()
+	}
+	defer m.finish()
+
+	for _, conn := range conns {
+		r.start(conn)
+	}
+	// 先停止接收协程再关闭套接字
+	defer r.stop()
+
+	start := time.Now()
+	m.queue = m.queue[:0]
+	for _, t := range m.targets {
+		t.next = start
+		t.finished = false
+		heap.Push(&m.queue, t)
+	}
+
+	timeout := time.NewTimer(m.Timeout)
+	defer timeout.Stop()
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-done:
+			return nil
+		case <-timeout.C:
+			return nil
+		case err = <-r.errs:
+			return err
+		case data := <-r.recv:
+			m.dispatch(data)
+		case <-timer.C:
+			m.schedule(start)
+			if m.queue.Len() > 0 {
+				timer.Reset(time.Until(m.queue[0].next))
+			}
+		}
+		if m.queue.Len() == 0 {
+			return nil
+		}
+	}
+}
+
+// Stop 停止正在运行的Run，可以在任意协程中多次调用，没有在运行时什么也不做
+func (m *MultiPinger) Stop() {
+	stopRun(&m.lock, &m.done)
+}
+
+// listen 为目标用到的每个协议族建立一个套接字，并为目标选择套接字和ID
+func (m *MultiPinger) listen() ([]*icmpConn, error) {
+	var conns []*icmpConn
+	var conn4, conn6 *icmpConn
+	var err error
+	for _, t := range m.targets {
+		p := t.pinger
+		p.protocol = m.protocol
+		conn := conn6
+		if p.ipv4 {
+			conn = conn4
+		}
+		if conn == nil {
+			conn, err = listenICMP(p.ipv4, m.Privileged(), nil, m.TTL)
+			if err != nil {
+				break
+			}
+			conns = append(conns, conn)
+			if p.ipv4 {
+				conn4 = conn
+			} else {
+				conn6 = conn
+			}
+		}
+		err = p.checkMarking()
+		if err != nil {
+			break
+		}
+		err = p.checkSize()
+		if err != nil {
+			break
+		}
+		err = p.checkInterval()
+		if err != nil {
+			break
+		}
+		// 发包按照Interval统一调度，不支持泛洪和自适应模式
+		if p.Flood || p.Adaptive {
+			err = fmt.Errorf("flood and adaptive modes are not supported for %s", p.TargetAddr)
+			break
+		}
+		// 所有目标共用ICMP套接字，不支持TCP和UDP探测，也不能单独绑定网口和设置fwmark
+		if p.ProbeType != ProbeICMP {
+			err = fmt.Errorf("unsupported probe type %d for %s", p.ProbeType, p.TargetAddr)
+			break
+		}
+		if p.bindDevice() != "" || p.Mark != 0 {
+			err = fmt.Errorf("interface, VRF and mark are not supported for %s", p.TargetAddr)
+			break
+		}
+		// 手动填写IPv4首部时每个目标需要自己的源地址，超过出接口MTU时自己分片
+		if conn.ipv4 && conn.privileged {
+			err = p.resolveSource()
+			if err != nil {
+				break
+			}
+			p.mtu, _ = routeMTU(p.routeTarget(), p.Mark)
+		}
+		t.conn = conn
+		p.id = m.id
+		if !conn.privileged {
+			p.id = conn.id
+		}
+		for _, trackerUUID := range p.trackerUUIDs {
+			m.trackers[trackerUUID] = t
+		}
+	}
+	if err != nil {
+		for _, conn := range conns {
+			conn.close()
+		}
+		return nil, err
+	}
+	return conns, nil
+}
+
+// schedule 处理所有到期的目标：发包，或者在发完Count个包并等待Wait后结束该目标
+func (m *MultiPinger) schedule(start time.Time) {
+	now := time.Now()
+	for m.queue.Len() > 0 && !m.queue[0].next.After(now) {
+		t := heap.Pop(&m.queue).(*multiTarget)
+		p := t.pinger
+		if now.Sub(start) >= p.Timeout || (p.Count > 0 && p.PacketsSent >= p.Count) {
+			m.finishTarget(t)
+			continue
+		}
+		err := p.sendICMP(t.conn)
+		if err != nil {
+			// 单个目标发送失败（如没有路由）不影响其他目标
+			fmt.Println(fmt.Sprintf("Send to %s error:%s", p.TargetIpaddr, err.Error()))
+			m.finishTarget(t)
+			continue
+		}
+		// 序号用完后会产生新的tracker
+		m.trackers[p.trackerUUIDs[len(p.trackerUUIDs)-1]] = t
+
+		delay := p.Interval
+		if p.Count > 0 && p.PacketsSent >= p.Count {
+			delay = m.Wait
+		}
+		if remain := p.Timeout - now.Sub(start); remain < delay {
+			delay = remain
+		}
+		t.next = now.Add(delay)
+		heap.Push(&m.queue, t)
+	}
+}
+
+// dispatch 根据负载中的tracker将应答交给对应的目标，差错报文根据其中引用的echo请求分发
+func (m *MultiPinger) dispatch(recv *recvPacket) {
+	// 发送时间戳和无法解析的数据包没有ICMP报文
+	msg := recv.data.message()
+	if msg == nil {
+		return
+	}
+	var t *multiTarget
+	echo, ok := msg.Body.(*icmp.Echo)
+	if ok {
+		t = m.trackerTarget(echo)
+	} else if quoted, icmpErr := decodeICMPError(recv.data); icmpErr != nil {
+		_, isV4 := recv.data.(*ICMPv4Data)
+		dst, echo, ok := quotedEcho(quoted, isV4)
+		if !ok {
+			return
+		}
+		t = m.trackerTarget(echo)
+		if t == nil {
+			// 引用的数据报被截断时按照目的地址和ID查找
+			t = m.echoTarget(dst, echo.ID)
+		}
+	}
+	if t == nil || t.finished {
+		return
+	}
+	// 目标自己会校验来源地址、类型、ID和序号
+	t.pinger.processPacket(recv)
+	if t.pinger.Count > 0 && t.pinger.PacketsRecv >= t.pinger.Count {
+		m.finishTarget(t)
+	}
+}
+
+// trackerTarget 根据echo负载中的tracker查找目标
+func (m *MultiPinger) trackerTarget(echo *icmp.Echo) *multiTarget {
+	_, trackerUUID, ok := parsePayload(echo.Data)
+	if !ok {
+		return nil
+	}
+	return m.trackers[trackerUUID]
+}
+
+// echoTarget 根据目的地址和ID查找目标
+func (m *MultiPinger) echoTarget(dst net.IP, id int) *multiTarget {
+	for _, t := range m.targets {
+		if t.pinger.id == id && t.pinger.TargetIpaddr.IP.Equal(dst) {
+			return t
+		}
+	}
+	return nil
+}
+
+// finishTarget 结束一个目标并触发它的OnFinish，同时将其移出队列
+func (m *MultiPinger) finishTarget(t *multiTarget) {
+	t.finished = true
+	t.pinger.finish()
+	if t.index >= 0 {
+		heap.Remove(&m.queue, t.index)
+	}
+}
+
+// finish Run结束时结束剩余的目标并触发OnFinish
+func (m *MultiPinger) finish() {
+	for _, t := range m.targets {
+		if !t.finished {
+			t.finished = true
+			t.pinger.finish()
+		}
+	}
+	if handler := m.OnFinish; handler != nil {
+		handler(m.Statistics())
+	}
+}
+
+// targetQueue 按照next排序的最小堆
+type targetQueue []*multiTarget
+
+func (q targetQueue) Len() int { return len(q) }
+
+func (q targetQueue) Less(i, j int) bool { return q[i].next.Before(q[j].next) }
+
+func (q targetQueue) Swap(i, j int) {
+	q[i], q[j] = q[j], q[i]
+	q[i].index = i
+	q[j].index = j
+}
+
+func (q *targetQueue) Push(x any) {
+	t := x.(*multiTarget)
+	t.index = len(*q)
+	*q = append(*q, t)
+}
+
+func (q *targetQueue) Pop() any {
+	old := *q
+	n := len(old)
+	t := old[n-1]
+	old[n-1] = nil
+	t.index = -1
+	*q = old[:n-1]
+	return t
+}
@@ -0,0 +1,105 @@
+package shlping
+
+import (
+	"github.com/google/uuid"
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv4"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestMultiPingerRejectsInvalidTarget(t *testing.T) {
+	tests := []struct {
+		name   string
+		modify func(p *Pinger)
+	}{
+		{name: "zero interval", modify: func(p *Pinger) { p.Interval = 0 }},
+		{name: "negative interval", modify: func(p *Pinger) { p.Interval = -time.Second }},
+		{name: "flood", modify: func(p *Pinger) { p.Flood = true }},
+		{name: "adaptive", modify: func(p *Pinger) { p.Adaptive = true }},
+		{name: "invalid TTL", modify: func(p *Pinger) { p.TTL = 0 }},
+		{name: "payload too small", modify: func(p *Pinger) { p.Size = 8 }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := NewMultiPinger()
+			_, err := m.AddTarget("127.0.0.1")
+			if err != nil {
+				t.Fatal(err)
+			}
+			p, err := m.AddTarget("127.0.0.2")
+			if err != nil {
+				t.Fatal(err)
+			}
+			tt.modify(p)
+			if err := m.Run(); err == nil {
+				t.Fatal("Run accepted an invalid target")
+			}
+		})
+	}
+}
+
+// 差错报文按照引用的echo请求分发，引用被截断没有tracker时按照目的地址和ID查找目标
+func TestMultiPingerDispatchICMPError(t *testing.T) {
+	m := NewMultiPinger()
+	for _, addr := range []string{"10.2.0.2", "10.2.0.3"} {
+		p, err := m.AddTarget(addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		p.id = m.id
+	}
+	for _, target := range m.targets {
+		for _, trackerUUID := range target.pinger.trackerUUIDs {
+			m.trackers[trackerUUID] = target
+		}
+	}
+	rr, err := buildIPv4Options(true, TimestampNone)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// quote 发往dst的echo请求，截断到IP首部之后的n字节，n<0时不截断
+	quote := func(dst net.IP, id int, tracker uuid.UUID, options []byte, n int) []byte {
+		data := &ICMPv4Data{
+			IPv4Header: &ipv4.Header{TTL: 1, Src: net.IPv4(10, 1, 0, 1), Dst: dst, Options: options},
+			ICMPData:   &icmp.Message{Type: ipv4.ICMPTypeEcho, Body: &icmp.Echo{ID: id, Data: makePayload(time.Now(), tracker, defaultSize)}},
+		}
+		b, err := data.Marshal()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n >= 0 {
+			b = b[:data.IPv4Header.Len+n]
+		}
+		return b
+	}
+	first, second := m.targets[0].pinger, m.targets[1].pinger
+	tests := []struct {
+		name   string
+		quoted []byte
+		// wantErrors 两个目标收到的差错数
+		wantErrors [2]int
+	}{
+		{name: "tracker", quoted: quote(first.TargetIpaddr.IP, m.id, first.trackerUUIDs[0], nil, -1), wantErrors: [2]int{1, 0}},
+		{name: "tracker with options", quoted: quote(second.TargetIpaddr.IP, m.id, second.trackerUUIDs[0], rr, -1), wantErrors: [2]int{0, 1}},
+		{name: "truncated", quoted: quote(second.TargetIpaddr.IP, m.id, uuid.Nil, nil, icmpEchoHeaderLen), wantErrors: [2]int{0, 1}},
+		{name: "truncated with options", quoted: quote(second.TargetIpaddr.IP, m.id, uuid.Nil, rr, icmpEchoHeaderLen), wantErrors: [2]int{0, 1}},
+		{name: "truncated other ID", quoted: quote(second.TargetIpaddr.IP, m.id+1, uuid.Nil, nil, icmpEchoHeaderLen)},
+		{name: "truncated other destination", quoted: quote(net.IPv4(10, 2, 0, 4), m.id, uuid.Nil, nil, icmpEchoHeaderLen)},
+		{name: "foreign tracker", quoted: quote(second.TargetIpaddr.IP, m.id, uuid.New(), nil, -1)},
+		{name: "quote too short", quoted: quote(second.TargetIpaddr.IP, m.id, uuid.Nil, nil, icmpEchoHeaderLen-1)},
+		{name: "options cut", quoted: quote(second.TargetIpaddr.IP, m.id, uuid.Nil, rr, -1)[:ipv4.HeaderLen+icmpEchoHeaderLen]},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			first.PacketsErrors, second.PacketsErrors = 0, 0
+			data := testICMPv4Error(t, ipv4.ICMPTypeTimeExceeded, 0, append([]byte{0, 0, 0, 0}, tt.quoted...))
+			m.dispatch(&recvPacket{data: data, receivedAt: time.Now()})
+			got := [2]int{first.PacketsErrors, second.PacketsErrors}
+			if got != tt.wantErrors {
+				t.Errorf("errors %v, want %v", got, tt.wantErrors)
+			}
+		})
+	}
+}
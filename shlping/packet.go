@@ -1,10 +1,15 @@
 package shlping
 
 import (
+	"encoding/binary"
+	"errors"
 	"fmt"
+	"github.com/google/uuid"
 	"golang.org/x/net/icmp"
 	"golang.org/x/net/ipv4"
-	"golang.org/x/sys/unix"
+	"golang.org/x/net/ipv6"
+	"io"
+	"math"
 	"net"
 	"time"
 )
@@ -30,47 +35,386 @@ type Packet struct {
 	Seq int
 	// TTL 包的TTL
 	Ttl int
+	// Tos 应答的TOS，IPv6为流量类别，高6位为DSCP，低2位为ECN
+	Tos int
 	// ID ICMP包的唯一ID
 	ID int
+	// Options 应答IPv4首部中的选项，没有选项时为nil
+	Options *IPv4Options
+	// TCPFlags TCP探测应答的标志位，SYN|ACK表示端口开放，RST表示端口关闭，ICMP探测为0
+	TCPFlags int
+	// PortUnreachable UDP探测的应答是否为目的地址发回的端口不可达，false表示应用程序的应答
+	PortUnreachable bool
+	// RecvTimestamp 计算RTT使用的接收时间的来源
+	RecvTimestamp TimestampSource
+	// SendTimestamp 计算RTT使用的发送时间的来源
+	SendTimestamp TimestampSource
 }
 
+// recvPacket 接收协程收到的数据包，与其中的数据一起位于接收缓冲区中，
+// 只在消费者从通道中取出下一个包之前有效
+type recvPacket struct {
+	data icmpPacket
+	// receivedAt 收到数据包的时间
+	receivedAt time.Time
+	// source receivedAt的来源
+	source TimestampSource
+	// hwStamp 网卡的硬件接收时间戳，只能与硬件发送时间戳相减，零值表示没有
+	hwStamp time.Time
+}
+
+// icmpPacket 收到的ICMP包，屏蔽IPv4与IPv6的差异
+type icmpPacket interface {
+	// src 发送方地址，可能引用接收缓冲区，保存时需要复制
+	src() net.IP
+	// hopLimit IPv4的TTL或IPv6的跳数限制
+	hopLimit() int
+	// trafficClass IPv4的TOS或IPv6的流量类别
+	trafficClass() int
+	// icmpLen ICMP报文的长度
+	icmpLen() int
+	// message 解析后的ICMP报文
+	message() *icmp.Message
+}
+
+// ICMPv4Data IPv4首部加ICMP报文
 type ICMPv4Data struct {
 	IPv4Header *ipv4.Header
 	ICMPData   *icmp.Message
+	// raw 原始的ICMP报文，解析后的ICMPData中没有需要分片报文的下一跳MTU
+	raw []byte
 }
 
+// MarshalLen 序列化后的长度，为IPv4首部（选项补齐到4字节）加上ICMP报文的长度
+func (i *ICMPv4Data) MarshalLen() int {
+	return i.headerLen() + i.icmpMarshalLen()
+}
+
+// headerLen 带选项的IPv4首部长度
+func (i *ICMPv4Data) headerLen() int {
+	return ipv4HeaderLen(i.IPv4Header)
+}
+
+// icmpMarshalLen ICMP报文的长度，类型、代码和校验和之后为报文体
+func (i *ICMPv4Data) icmpMarshalLen() int {
+	if i.ICMPData.Body == nil {
+		return 4
+	}
+	return 4 + i.ICMPData.Body.Len(protocolICMP)
+}
+
+// Marshal 序列化为一个长度正好为TotalLen的新切片，见MarshalTo
 func (i *ICMPv4Data) Marshal() ([]byte, error) {
-	var err error
-	res := make([]byte, 4096)
-	ipHeader, err := i.IPv4Header.Marshal()
+	b := make([]byte, i.MarshalLen())
+	n, err := i.MarshalTo(b)
 	if err != nil {
-		fmt.Println(fmt.Sprintf("ip header marshal error:%s:", err.Error()))
+		fmt.Println(fmt.Sprintf("icmpv4 data marshal error:%s:", err.Error()))
 		return nil, err
 	}
-	copy(res[:], ipHeader)
+	return b[:n], nil
+}
 
-	icmpData, err := i.ICMPData.Marshal(nil)
+// MarshalTo 将IPv4首部和ICMP报文写入b，返回写入的长度。b至少为MarshalLen字节，
+// 只写入TotalLen字节，不会分配内存（echo之外的报文体由x/net/icmp序列化）。
+// 首部长度、总长度和协议根据内容填写，IP首部和ICMP的校验和都在这里计算，
+// 计算结果同时写回IPv4Header
+func (i *ICMPv4Data) MarshalTo(b []byte) (int, error) {
+	hdrLen := i.headerLen()
+	n := hdrLen + i.icmpMarshalLen()
+	if len(b) < n {
+		return 0, io.ErrShortBuffer
+	}
+	icmpType, ok := i.ICMPData.Type.(ipv4.ICMPType)
+	if !ok {
+		return 0, fmt.Errorf("not an ICMPv4 message type: %v", i.ICMPData.Type)
+	}
+	err := putIPv4Header(b, i.IPv4Header, n, protocolICMP)
 	if err != nil {
-		fmt.Println(fmt.Sprintf("icmpData marshal error:%s:", err.Error()))
-		return nil, err
+		return 0, err
+	}
+
+	msg := b[hdrLen:n]
+	msg[0] = byte(icmpType)
+	msg[1] = byte(i.ICMPData.Code)
+	msg[2], msg[3] = 0, 0
+	switch body := i.ICMPData.Body.(type) {
+	case nil:
+	case *icmp.Echo:
+		binary.BigEndian.PutUint16(msg[4:6], uint16(body.ID))
+		binary.BigEndian.PutUint16(msg[6:8], uint16(body.Seq))
+		copy(msg[icmpEchoHeaderLen:], body.Data)
+	default:
+		data, err := body.Marshal(protocolICMP)
+		if err != nil {
+			return 0, err
+		}
+		copy(msg[4:], data)
+	}
+	binary.BigEndian.PutUint16(msg[2:4], internetChecksum(msg))
+	return n, nil
+}
+
+// ipv4HeaderLen 带选项的IPv4首部长度，选项补齐到4字节
+func ipv4HeaderLen(h *ipv4.Header) int {
+	return ipv4.HeaderLen + (len(h.Options)+3)&^3
+}
+
+// putIPv4Header 将IPv4首部写入b并计算首部校验和，totalLen为整个数据报的长度，proto为上层协议。
+// 首部长度、总长度、协议和校验和同时写回h。ICMP和TCP探测都通过这里生成IPv4首部
+func putIPv4Header(b []byte, h *ipv4.Header, totalLen, proto int) error {
+	hdrLen := ipv4HeaderLen(h)
+	if hdrLen > ipv4.HeaderLen+ipOptMaxLen {
+		return fmt.Errorf("IPv4 options too long: %d bytes", len(h.Options))
+	}
+	if totalLen > math.MaxUint16 {
+		return fmt.Errorf("packet too large: %d bytes", totalLen)
 	}
-	copy(res[len(ipHeader):], icmpData)
-	return res, nil
+	if totalLen < hdrLen || len(b) < hdrLen {
+		return io.ErrShortBuffer
+	}
+	dst := h.Dst.To4()
+	if dst == nil {
+		return fmt.Errorf("invalid IPv4 destination address %v", h.Dst)
+	}
+
+	b[0] = byte(ipv4.Version<<4 | hdrLen>>2)
+	b[1] = byte(h.TOS)
+	binary.BigEndian.PutUint16(b[2:4], uint16(totalLen))
+	binary.BigEndian.PutUint16(b[4:6], uint16(h.ID))
+	binary.BigEndian.PutUint16(b[6:8], uint16(int(h.Flags)<<13|h.FragOff&0x1fff))
+	b[8] = byte(h.TTL)
+	b[9] = byte(proto)
+	b[10], b[11] = 0, 0
+	// 源地址为0时由内核填写
+	if src := h.Src.To4(); src != nil {
+		copy(b[12:16], src)
+	} else {
+		clear(b[12:16])
+	}
+	copy(b[16:20], dst)
+	clear(b[ipv4.HeaderLen+copy(b[ipv4.HeaderLen:hdrLen], h.Options) : hdrLen])
+	checksum := internetChecksum(b[:hdrLen])
+	binary.BigEndian.PutUint16(b[10:12], checksum)
+
+	h.Version, h.Len, h.TotalLen, h.Protocol, h.Checksum = ipv4.Version, hdrLen, totalLen, proto, int(checksum)
+	return nil
 }
 
+// Unmarshal 解析IPv4首部和ICMP报文，首部长度按照IHL计算，可能带有选项。总长度、
+// 首部校验和（见parseIPv4Header）以及ICMP校验和都必须正确，超过总长度的部分忽略。
+// 解析结果（包括地址、选项和echo的负载）引用b，IPv4Header为nil时新建，否则重用
 func (i *ICMPv4Data) Unmarshal(b []byte) error {
+	return i.unmarshal(b, &icmp.Message{}, &icmp.Echo{})
+}
+
+// unmarshal 与Unmarshal相同，echo报文解析到msg和echo中
+func (i *ICMPv4Data) unmarshal(b []byte, msg *icmp.Message, echo *icmp.Echo) error {
 	var err error
-	err = i.IPv4Header.Parse(b[:ipv4.HeaderLen])
+	if i.IPv4Header == nil {
+		i.IPv4Header = &ipv4.Header{}
+	}
+	b, err = parseIPv4Header(i.IPv4Header, b)
 	if err != nil {
 		fmt.Println(fmt.Sprintf("ipv4 header unmarshal error:%s:", err.Error()))
 		return err
 	}
+	if i.IPv4Header.Protocol != protocolICMP {
+		return fmt.Errorf("not an ICMP datagram, protocol %d", i.IPv4Header.Protocol)
+	}
+	raw := b[i.IPv4Header.Len:]
+	if internetChecksum(raw) != 0 {
+		err = errors.New("bad ICMP checksum")
+		fmt.Println(fmt.Sprintf("icmpData unmarshal error:%s:", err.Error()))
+		return err
+	}
 
-	icmpData, err := icmp.ParseMessage(unix.IPPROTO_ICMP, b[ipv4.HeaderLen:])
+	icmpData, err := parseMessage(protocolICMP, raw, msg, echo)
 	if err != nil {
 		fmt.Println(fmt.Sprintf("icmpData unmarshal error:%s:", err.Error()))
 		return err
 	}
 	i.ICMPData = icmpData
+	i.raw = raw
 	return nil
 }
+
+// parseIPv4Header 解析并校验IPv4首部。首部长度按照IHL计算，不能小于20字节，总长度不能小于
+// 首部长度、也不能超过收到的长度，不带选项时首部校验和必须正确。本机接收时内核会在记录路由和
+// 时间戳选项中写入自己的地址和时间却不更新校验和，因此带选项的首部不校验（内核已经校验过）。
+// 返回按照总长度截断后的数据报。地址和选项直接引用b，不分配内存
+func parseIPv4Header(h *ipv4.Header, b []byte) ([]byte, error) {
+	if len(b) < ipv4.HeaderLen {
+		return nil, fmt.Errorf("IPv4 header too short: %d bytes", len(b))
+	}
+	hdrLen := int(b[0]&0x0f) << 2
+	if hdrLen < ipv4.HeaderLen || hdrLen > len(b) {
+		return nil, fmt.Errorf("invalid IPv4 header length %d, received %d bytes", hdrLen, len(b))
+	}
+	flagsAndOff := int(binary.BigEndian.Uint16(b[6:8]))
+	*h = ipv4.Header{
+		Version:  int(b[0] >> 4),
+		Len:      hdrLen,
+		TOS:      int(b[1]),
+		TotalLen: int(binary.BigEndian.Uint16(b[2:4])),
+		ID:       int(binary.BigEndian.Uint16(b[4:6])),
+		Flags:    ipv4.HeaderFlags(flagsAndOff >> 13),
+		FragOff:  flagsAndOff & 0x1fff,
+		TTL:      int(b[8]),
+		Protocol: int(b[9]),
+		Checksum: int(binary.BigEndian.Uint16(b[10:12])),
+		Src:      net.IP(b[12:16:16]),
+		Dst:      net.IP(b[16:20:20]),
+	}
+	if hdrLen > ipv4.HeaderLen {
+		h.Options = b[ipv4.HeaderLen:hdrLen:hdrLen]
+	}
+	if h.Version != ipv4.Version {
+		return nil, fmt.Errorf("invalid IP version %d", h.Version)
+	}
+	if h.TotalLen < h.Len || h.TotalLen > len(b) {
+		return nil, fmt.Errorf("invalid IPv4 total length %d, header length %d, received %d bytes", h.TotalLen, h.Len, len(b))
+	}
+	if h.Len == ipv4.HeaderLen && internetChecksum(b[:h.Len]) != 0 {
+		return nil, errors.New("bad IPv4 header checksum")
+	}
+	return b[:h.TotalLen], nil
+}
+
+// parseMessage 解析ICMP报文。echo请求和应答直接解析到msg和echo中，负载引用b，
+// 不分配内存；其他报文交给x/net/icmp解析
+func parseMessage(proto int, b []byte, msg *icmp.Message, echo *icmp.Echo) (*icmp.Message, error) {
+	if len(b) < icmpEchoHeaderLen {
+		return icmp.ParseMessage(proto, b)
+	}
+	var typ icmp.Type
+	switch {
+	case proto == protocolICMP && (b[0] == byte(ipv4.ICMPTypeEchoReply) || b[0] == byte(ipv4.ICMPTypeEcho)):
+		typ = ipv4.ICMPType(b[0])
+	case proto == protocolIPv6ICMP && (b[0] == byte(ipv6.ICMPTypeEchoReply) || b[0] == byte(ipv6.ICMPTypeEchoRequest)):
+		typ = ipv6.ICMPType(b[0])
+	default:
+		return icmp.ParseMessage(proto, b)
+	}
+	*echo = icmp.Echo{
+		ID:   int(binary.BigEndian.Uint16(b[4:6])),
+		Seq:  int(binary.BigEndian.Uint16(b[6:8])),
+		Data: b[icmpEchoHeaderLen:],
+	}
+	*msg = icmp.Message{
+		Type:     typ,
+		Code:     int(b[1]),
+		Checksum: int(binary.BigEndian.Uint16(b[2:4])),
+		Body:     echo,
+	}
+	return msg, nil
+}
+
+// NextHopMTU 需要分片的目的不可达报文（类型3代码4）中路由器给出的下一跳MTU，
+// 其他报文或者路由器没有给出时返回0（RFC 1191）
+func (i *ICMPv4Data) NextHopMTU() int {
+	if i.ICMPData == nil || i.ICMPData.Type != ipv4.ICMPTypeDestinationUnreachable || i.ICMPData.Code != 4 {
+		return 0
+	}
+	if len(i.raw) < icmpEchoHeaderLen {
+		return 0
+	}
+	return int(binary.BigEndian.Uint16(i.raw[6:8]))
+}
+
+func (i *ICMPv4Data) src() net.IP { return i.IPv4Header.Src }
+
+func (i *ICMPv4Data) hopLimit() int { return i.IPv4Header.TTL }
+
+func (i *ICMPv4Data) trafficClass() int { return i.IPv4Header.TOS }
+
+func (i *ICMPv4Data) icmpLen() int { return i.IPv4Header.TotalLen - i.IPv4Header.Len }
+
+func (i *ICMPv4Data) message() *icmp.Message { return i.ICMPData }
+
+// ICMPv6Data IPv6首部加ICMPv6报文。IPv6的套接字不能手动写入IP首部，
+// 校验和由内核计算，因此IPv6Header只在接收时根据对端地址和控制消息填写
+type ICMPv6Data struct {
+	IPv6Header *ipv6.Header
+	ICMPData   *icmp.Message
+}
+
+// Marshal 只序列化ICMPv6报文，校验和留给内核计算
+func (i *ICMPv6Data) Marshal() ([]byte, error) {
+	icmpData, err := i.ICMPData.Marshal(nil)
+	if err != nil {
+		fmt.Println(fmt.Sprintf("icmpData marshal error:%s:", err.Error()))
+		return nil, err
+	}
+	return icmpData, nil
+}
+
+// Unmarshal 解析ICMPv6报文，b中不包含IPv6首部，echo的负载引用b
+func (i *ICMPv6Data) Unmarshal(b []byte) error {
+	return i.unmarshal(b, &icmp.Message{}, &icmp.Echo{})
+}
+
+// unmarshal 与Unmarshal相同，echo报文解析到msg和echo中
+func (i *ICMPv6Data) unmarshal(b []byte, msg *icmp.Message, echo *icmp.Echo) error {
+	icmpData, err := parseMessage(protocolIPv6ICMP, b, msg, echo)
+	if err != nil {
+		fmt.Println(fmt.Sprintf("icmpData unmarshal error:%s:", err.Error()))
+		return err
+	}
+	i.ICMPData = icmpData
+	if i.IPv6Header != nil {
+		i.IPv6Header.PayloadLen = len(b)
+	}
+	return nil
+}
+
+func (i *ICMPv6Data) src() net.IP { return i.IPv6Header.Src }
+
+func (i *ICMPv6Data) hopLimit() int { return i.IPv6Header.HopLimit }
+
+func (i *ICMPv6Data) trafficClass() int { return i.IPv6Header.TrafficClass }
+
+func (i *ICMPv6Data) icmpLen() int { return i.IPv6Header.PayloadLen }
+
+func (i *ICMPv6Data) message() *icmp.Message { return i.ICMPData }
+
+// makePayload 生成echo请求的负载：8字节发送时间（纳秒，大端）+ 16字节tracker，
+// 其余部分用1填充，size由checkSize保证不小于24。
+// 发送时间只用于匹配应答，RTT根据本地记录的发送时间计算
+func makePayload(sentAt time.Time, tracker uuid.UUID, size int) []byte {
+	payload := make([]byte, size)
+	binary.BigEndian.PutUint64(payload, uint64(sentAt.UnixNano()))
+	copy(payload[timeSliceLength:], tracker[:])
+	for i := timeSliceLength + trackerLength; i < size; i++ {
+		payload[i] = 1
+	}
+	return payload
+}
+
+// parsePayload 从echo应答的负载中解析发送时间和tracker
+func parsePayload(payload []byte) (time.Time, uuid.UUID, bool) {
+	if len(payload) < timeSliceLength+trackerLength {
+		return time.Time{}, uuid.UUID{}, false
+	}
+	sentAt := time.Unix(0, int64(binary.BigEndian.Uint64(payload)))
+	tracker, err := uuid.FromBytes(payload[timeSliceLength : timeSliceLength+trackerLength])
+	if err != nil {
+		return time.Time{}, uuid.UUID{}, false
+	}
+	return sentAt, tracker, true
+}
+
+// icmpEchoHeaderLen ICMP echo首部长度：类型、代码、校验和、ID、序号
+const icmpEchoHeaderLen = 8
+
+// parseQuotedIPv4 解析ICMP差错报文中引用的原始数据报，返回其IP首部和之后的传输层数据。
+// 差错报文至少引用原始IP首部和之后的8个字节
+func parseQuotedIPv4(b []byte) (*ipv4.Header, []byte, error) {
+	header, err := ipv4.ParseHeader(b)
+	if err != nil {
+		return nil, nil, err
+	}
+	if header.Len > len(b) {
+		return nil, nil, errors.New("quoted datagram too short")
+	}
+	return header, b[header.Len:], nil
+}
@@ -0,0 +1,232 @@
+package shlping
+
+import (
+	"bytes"
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv4"
+	"net"
+	"reflect"
+	"testing"
+)
+
+func TestICMPv4DataRoundTrip(t *testing.T) {
+	recordRoute, err := buildIPv4Options(true, TimestampNone)
+	if err != nil {
+		t.Fatal(err)
+	}
+	timestamp, err := buildIPv4Options(false, TimestampAndAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	echo := &icmp.Echo{ID: 0x1234, Seq: 7, Data: []byte("0123456789abcdef01234567")}
+	tests := []struct {
+		name    string
+		options []byte
+		flags   ipv4.HeaderFlags
+		fragOff int
+		typ     ipv4.ICMPType
+		body    icmp.MessageBody
+		// trailing 超过总长度的多余数据
+		trailing []byte
+	}{
+		{name: "echo", flags: ipv4.DontFragment, typ: ipv4.ICMPTypeEcho, body: echo},
+		{name: "echo reply with odd payload", typ: ipv4.ICMPTypeEchoReply, body: &icmp.Echo{ID: 1, Seq: 2, Data: []byte("odd")}},
+		{name: "record route", options: recordRoute, flags: ipv4.DontFragment, typ: ipv4.ICMPTypeEcho, body: echo},
+		{name: "timestamp and address", options: timestamp, typ: ipv4.ICMPTypeEcho, body: echo},
+		{name: "options padded to 4 bytes", options: []byte{ipOptNop, ipOptNop, ipOptNop}, typ: ipv4.ICMPTypeEcho, body: echo},
+		{name: "more fragments", flags: ipv4.MoreFragments, fragOff: 185, typ: ipv4.ICMPTypeEcho, body: echo},
+		{name: "largest fragment offset", fragOff: 0x1fff, typ: ipv4.ICMPTypeEcho, body: echo},
+		{name: "time exceeded", typ: ipv4.ICMPTypeTimeExceeded, body: &icmp.TimeExceeded{Data: make([]byte, ipv4.HeaderLen+icmpEchoHeaderLen)}},
+		{name: "trailing bytes ignored", typ: ipv4.ICMPTypeEcho, body: echo, trailing: []byte{0xde, 0xad}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			src := &ICMPv4Data{
+				IPv4Header: &ipv4.Header{
+					TOS:     0xb8,
+					ID:      42,
+					TTL:     64,
+					Flags:   tt.flags,
+					FragOff: tt.fragOff,
+					Src:     net.IPv4(10, 1, 0, 1),
+					Dst:     net.IPv4(10, 2, 0, 2),
+					Options: tt.options,
+				},
+				ICMPData: &icmp.Message{Type: tt.typ, Body: tt.body},
+			}
+			b, err := src.Marshal()
+			if err != nil {
+				t.Fatal(err)
+			}
+			hdrLen := ipv4.HeaderLen + (len(tt.options)+3)&^3
+			if src.IPv4Header.Len != hdrLen || src.IPv4Header.TotalLen != len(b) {
+				t.Fatalf("header length %d total length %d, want %d %d", src.IPv4Header.Len, src.IPv4Header.TotalLen, hdrLen, len(b))
+			}
+
+			got := &ICMPv4Data{}
+			err = got.Unmarshal(append(b, tt.trailing...))
+			if err != nil {
+				t.Fatal(err)
+			}
+			h := got.IPv4Header
+			if h.Len != hdrLen || h.TotalLen != len(b) || h.TOS != 0xb8 || h.ID != 42 || h.TTL != 64 || h.Protocol != protocolICMP {
+				t.Errorf("header = %+v", h)
+			}
+			if h.Flags != tt.flags || h.FragOff != tt.fragOff {
+				t.Errorf("flags %v offset %d, want %v %d", h.Flags, h.FragOff, tt.flags, tt.fragOff)
+			}
+			if !h.Src.Equal(src.IPv4Header.Src) || !h.Dst.Equal(src.IPv4Header.Dst) {
+				t.Errorf("src %v dst %v", h.Src, h.Dst)
+			}
+			wantOptions := make([]byte, hdrLen-ipv4.HeaderLen)
+			copy(wantOptions, tt.options)
+			if !bytes.Equal(h.Options, wantOptions) {
+				t.Errorf("options %x, want %x", h.Options, wantOptions)
+			}
+			if got.ICMPData.Type != tt.typ || !reflect.DeepEqual(got.ICMPData.Body, tt.body) {
+				t.Errorf("message %v %+v, want %v %+v", got.ICMPData.Type, got.ICMPData.Body, tt.typ, tt.body)
+			}
+		})
+	}
+}
+
+func TestICMPv4DataMarshalToShortBuffer(t *testing.T) {
+	data := &ICMPv4Data{
+		IPv4Header: &ipv4.Header{TTL: 64, Dst: net.IPv4(10, 2, 0, 2)},
+		ICMPData:   &icmp.Message{Type: ipv4.ICMPTypeEcho, Body: &icmp.Echo{Data: make([]byte, 24)}},
+	}
+	_, err := data.MarshalTo(make([]byte, data.MarshalLen()-1))
+	if err == nil {
+		t.Fatal("MarshalTo into a short buffer succeeded")
+	}
+}
+
+// 从重用的缓冲区接收时，echo应答的解析不分配内存
+func TestUnmarshalEchoInPlace(t *testing.T) {
+	b, err := (&ICMPv4Data{
+		IPv4Header: &ipv4.Header{TTL: 64, Src: net.IPv4(10, 2, 0, 2), Dst: net.IPv4(10, 1, 0, 1)},
+		ICMPData:   &icmp.Message{Type: ipv4.ICMPTypeEchoReply, Body: &icmp.Echo{ID: 1, Seq: 2, Data: make([]byte, 56)}},
+	}).Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var slot recvSlot
+	allocs := testing.AllocsPerRun(100, func() {
+		slot.v4 = ICMPv4Data{IPv4Header: &slot.v4h}
+		err := slot.v4.unmarshal(b, &slot.msg, &slot.echo)
+		if err != nil {
+			t.Fatal(err)
+		}
+	})
+	if allocs != 0 {
+		t.Errorf("unmarshal allocated %v times per packet", allocs)
+	}
+	if slot.echo.Seq != 2 || len(slot.echo.Data) != 56 {
+		t.Errorf("echo = %+v", slot.echo)
+	}
+}
+
+// testIPv4Header 生成一个带有echo请求的合法数据报，mutate修改首部后重新计算首部校验和
+func testIPv4Header(t *testing.T, options []byte, mutate func(b []byte)) []byte {
+	b, err := (&ICMPv4Data{
+		IPv4Header: &ipv4.Header{TTL: 64, Src: net.IPv4(10, 1, 0, 1), Dst: net.IPv4(10, 2, 0, 2), Options: options},
+		ICMPData:   &icmp.Message{Type: ipv4.ICMPTypeEcho, Body: &icmp.Echo{ID: 1, Seq: 1, Data: make([]byte, 24)}},
+	}).Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mutate != nil {
+		mutate(b)
+		hdrLen := min(int(b[0]&0x0f)<<2, len(b))
+		if hdrLen >= ipv4.HeaderLen {
+			b[10], b[11] = 0, 0
+			checksum := internetChecksum(b[:hdrLen])
+			b[10], b[11] = byte(checksum>>8), byte(checksum)
+		}
+	}
+	return b
+}
+
+func TestParseIPv4HeaderRejects(t *testing.T) {
+	tests := []struct {
+		name string
+		b    []byte
+	}{
+		{name: "shorter than 20 bytes", b: testIPv4Header(t, nil, nil)[:ipv4.HeaderLen-1]},
+		{name: "IHL below 20 bytes", b: testIPv4Header(t, nil, func(b []byte) { b[0] = 0x44 })},
+		{name: "IHL beyond received", b: testIPv4Header(t, nil, func(b []byte) { b[0] = 0x4f })[:ipv4.HeaderLen+8]},
+		{name: "IPv6 version", b: testIPv4Header(t, nil, func(b []byte) { b[0] = 0x65 })},
+		{name: "total length below header", b: testIPv4Header(t, nil, func(b []byte) { b[2], b[3] = 0, ipv4.HeaderLen-1 })},
+		{name: "total length beyond received", b: testIPv4Header(t, nil, func(b []byte) { b[3]++ })},
+		{name: "bad header checksum", b: func() []byte {
+			b := testIPv4Header(t, nil, nil)
+			b[10] ^= 0xff
+			return b
+		}()},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := parseIPv4Header(&ipv4.Header{}, tt.b)
+			if err == nil {
+				t.Fatal("invalid header accepted")
+			}
+		})
+	}
+}
+
+// 本机接收时内核写入记录路由选项却不更新校验和，带选项的首部不校验
+func TestParseIPv4HeaderOptionsSkipChecksum(t *testing.T) {
+	rr, err := buildIPv4Options(true, TimestampNone)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := testIPv4Header(t, rr, nil)
+	b[ipv4.HeaderLen+2] += net.IPv4len
+	copy(b[ipv4.HeaderLen+3:], net.IPv4(10, 1, 0, 1).To4())
+	datagram, err := parseIPv4Header(&ipv4.Header{}, b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(datagram) != len(b) {
+		t.Errorf("datagram length %d, want %d", len(datagram), len(b))
+	}
+}
+
+func TestICMPv4DataUnmarshalBadICMPChecksum(t *testing.T) {
+	b := testIPv4Header(t, nil, nil)
+	b[len(b)-1] ^= 0xff
+	err := (&ICMPv4Data{}).Unmarshal(b)
+	if err == nil {
+		t.Fatal("bad ICMP checksum accepted")
+	}
+}
+
+func TestParseIPv4HeaderFragment(t *testing.T) {
+	tests := []struct {
+		name    string
+		field   uint16
+		flags   ipv4.HeaderFlags
+		fragOff int
+	}{
+		{name: "not fragmented", field: 0, flags: 0, fragOff: 0},
+		{name: "don't fragment", field: 0x4000, flags: ipv4.DontFragment, fragOff: 0},
+		{name: "first fragment", field: 0x2000, flags: ipv4.MoreFragments, fragOff: 0},
+		{name: "middle fragment", field: 0x2000 | 185, flags: ipv4.MoreFragments, fragOff: 185},
+		{name: "last fragment", field: 370, flags: 0, fragOff: 370},
+		{name: "largest offset", field: 0x1fff, flags: 0, fragOff: 0x1fff},
+		{name: "reserved bit", field: 0x8000 | 1, flags: 0x4, fragOff: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := testIPv4Header(t, nil, func(b []byte) { b[6], b[7] = byte(tt.field>>8), byte(tt.field) })
+			h := &ipv4.Header{}
+			_, err := parseIPv4Header(h, b)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if h.Flags != tt.flags || h.FragOff != tt.fragOff {
+				t.Errorf("flags %v offset %d, want %v %d", h.Flags, h.FragOff, tt.flags, tt.fragOff)
+			}
+		})
+	}
+}
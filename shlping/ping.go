@@ -1,11 +1,13 @@
 package shlping
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"github.com/google/uuid"
 	"golang.org/x/net/icmp"
 	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
 	"golang.org/x/sys/unix"
 	"math"
 	"math/rand"
@@ -20,6 +22,18 @@ const (
 	trackerLength    = len(uuid.UUID{})
 	protocolICMP     = unix.IPPROTO_ICMP
 	protocolIPv6ICMP = unix.IPPROTO_ICMPV6
+	// defaultTTL 默认的TTL
+	defaultTTL = 64
+	// minUserInterval 非root用户的最小发包间隔
+	minUserInterval = 2 * time.Millisecond
+	// floodInterval 泛洪模式没有应答时的发包间隔
+	floodInterval = 10 * time.Millisecond
+	// defaultWait 发完所有包后默认等待剩余应答的时间，与iputils ping相同
+	defaultWait = 10 * time.Second
+	// defaultSize 默认的负载大小，与iputils ping相同
+	defaultSize = 56
+	// maxTrackers 保留的tracker数，更早的tracker的应答不再接收
+	maxTrackers = 2
 )
 
 var (
@@ -42,36 +56,69 @@ func newPinger(addr string) *Pinger {
 		Interval:          time.Second,
 		Timeout:           time.Duration(math.MaxInt64),
 		Count:             -1,
-		TTL:               64,
-		Size:              0,
+		Wait:              defaultWait,
+		TTL:               defaultTTL,
+		Size:              defaultSize,
 		lock:              sync.Mutex{},
 		TargetAddr:        addr,
 		trackerUUIDs:      []uuid.UUID{firstUUID},
 		id:                r.Intn(math.MaxUint16),
 		sequence:          0,
 		awaitingSequences: firstSequence,
+		dscpStats:         make(map[int]*rttStats),
+		responderIndex:    make(map[string]*responder),
+		sentAt:            make(map[int]time.Time),
+		txSeqs:            make(map[uint32]int),
+		txStamps:          make(map[int]kernelStamp),
 		network:           "ip",
 		protocol:          "icmp",
+		RecordRtts:        true,
 	}
 }
 
 // Pinger 一个ping对象
 type Pinger struct {
-	// 两次发包时间间隔
+	// 两次发包时间间隔，泛洪和自适应模式下为没有应答时的最大间隔
 	Interval time.Duration
+	// Flood 泛洪模式（ping -f），收到应答后立即发送下一个请求，没有应答时至少每10ms发送一次。
+	// 与iputils ping相同，只有root用户可以使用
+	Flood bool
+	// Adaptive 自适应模式（ping -A），发包间隔跟随平滑后的RTT，非root用户不小于2ms，
+	// Interval同样要满足最小间隔的限制
+	Adaptive bool
 	// 请求超时时间，超过该时间后回重新发包或者退出
 	Timeout time.Duration
 	// 发包次数
 	Count int
+	// Wait 发完Count个包后等待剩余应答的时间，默认为10秒，超过后即使没有收齐应答也退出
+	Wait time.Duration
+	// ReplyTimeout 每个请求等待应答的时间（ping -W），RTT超过它的应答不计入统计，
+	// 发完Count个包后最多等待该时间。为0表示不限制
+	ReplyTimeout time.Duration
 	// 已经发送的包数
 	PacketsSent int
 	// 收到的包数
 	PacketsRecv int
 	// 收到重复的包数
 	PacketsRecvDuplicates int
+	// 收到的差错报文数，不包括重定向
+	PacketsErrors int
 
+	// RecordRtts 是否保存每个包的RTT，默认为true。其他统计信息（包括分位数）都是流式计算的，
+	// 长时间运行时应当关闭，否则占用的内存随收到的包数增长，Statistics每次都要复制所有的RTT
+	RecordRtts bool
 	// rtts 所有包的RTT
 	rtts []time.Duration
+	// rttStats RTT的最小值、最大值、平均值和标准差
+	rttStats rttStats
+	// histogram RTT直方图，用于计算分位数
+	histogram RTTHistogram
+	// jitter RTT的抖动
+	jitter jitter
+	// srtt 平滑后的RTT，用于自适应模式
+	srtt time.Duration
+	// dscpStats 按照应答中的DSCP分类的RTT统计
+	dscpStats map[int]*rttStats
 
 	OnSetup func()
 	// OnSend Pinger发送数据时触发
@@ -80,17 +127,57 @@ type Pinger struct {
 	OnRecv func(*Packet)
 	// OnDuplicateRecv Pinger重复收到数据包时触发
 	OnDuplicateRecv func(*Packet)
+	// OnError 收到与本Pinger发出的请求有关的ICMP差错报文时触发，Packet描述出错的请求，
+	// error为*UnreachableError、*TimeExceededError、*ParameterProblemError或*RedirectError
+	OnError func(*Packet, error)
+	// OnFinish Run结束时触发
+	OnFinish func(*Statistics)
 
 	// TTL 跳数
 	TTL int
-	// Size 数据包的大小
+	// DSCP 探测包的差分服务代码点（0-63），写入IPv4的TOS或IPv6的流量类别的高6位
+	DSCP int
+	// ECN 探测包的ECN代码点（0-3），写入TOS或流量类别的低2位
+	ECN int
+	// Size 负载的大小，默认为56字节。ICMP请求至少要包含发送时间和tracker（24字节），
+	// UDP探测至少要包含序号（2字节），更小时Run返回错误
 	Size int
+	// RecordRoute 是否携带记录路由选项，只对IPv4生效，不能与Timestamp同时使用
+	RecordRoute bool
+	// Timestamp 携带的时间戳选项，只对IPv4生效
+	Timestamp TimestampOption
+	// ProbeType 探测包的类型，默认为ProbeICMP。ProbeTCP向Port发送SYN，收到SYN-ACK或者RST
+	// 都算作应答：特权模式使用原始套接字发送SYN，非特权模式使用connect完成握手。
+	// ProbeUDP向Port发送UDP数据报，目的地址发回的端口不可达或者应用程序的应答都算作应答，
+	// 两种模式都使用普通的UDP套接字
+	ProbeType ProbeType
+	// KernelTimestamps 是否使用内核时间戳计算RTT，减少调度带来的误差。接收时间使用
+	// SO_TIMESTAMPING的软件接收时间戳（不支持时使用SO_TIMESTAMPNS），发送时间在网卡驱动支持时
+	// 使用软件发送时间戳。收发都有硬件时间戳时使用硬件时间戳，网卡的硬件时间戳需要事先开启，
+	// Pinger不会配置网卡。connect方式的TCP探测不支持
+	KernelTimestamps bool
+	// Port TCP和UDP探测的目的端口。为0时TCP使用80，UDP与traceroute相同，
+	// 从33434开始每个探测包加1
+	Port int
+	// Broadcast 是否允许ping广播地址（ping -b）。目的地址为广播或者组播地址时，
+	// 每个序号第一个应答计入PacketsRecv，之后的计为重复，并按照应答者分别统计。只支持ICMP探测
+	Broadcast bool
+	// MulticastInterface 组播ping时发送的网口，为空时按照路由选择
+	MulticastInterface string
+	// Interface 绑定的网口（SO_BINDTODEVICE，ping -I eth1），探测包只从该网口发出，
+	// 也只接收该网口收到的应答
+	Interface string
+	// VRF 绑定的VRF设备，按照VRF的路由表发送，不能与Interface同时使用
+	VRF string
+	// Mark 探测包的fwmark（SO_MARK），用于匹配策略路由，需要CAP_NET_ADMIN权限
+	Mark int
 	// Tracker 用于唯一表示数据包已经弃用
 	Tracker uint64
-	// 源地址
+	// SourceIpAddr Run时实际使用的源地址
 	SourceIpAddr *net.IPAddr
-	SourceAddr   string
-	lock         sync.Mutex
+	// SourceAddr 指定源地址，为空时根据路由自动选择
+	SourceAddr string
+	lock       sync.Mutex
 	// 目的地址
 	TargetIpaddr *net.IPAddr
 	TargetAddr   string
@@ -100,12 +187,48 @@ type Pinger struct {
 
 	id       int
 	sequence int
+	// done 正在进行的Run的停止信号，关闭后Run退出，没有在运行时为nil
+	done chan struct{}
 	// awaitingSequences 记录sequence防止重复接受
 	awaitingSequences map[uuid.UUID]map[int]struct{}
 	// network 为"ip","ip4","ip6"
 	network string
-	// protocol 为"icmp","udp"
+	// ipv4 目的地址是否为IPv4地址
+	ipv4 bool
+	// protocol 为"icmp","udp"，"udp"表示使用非特权的ICMP数据报套接字
 	protocol string
+	// ipOptions 探测包携带的IPv4选项
+	ipOptions []byte
+	// sentAt 探测包的发送时间，带有单调时钟读数，RTT根据序号计算
+	sentAt map[int]time.Time
+	// txSeqs 发送时间戳编号到探测包序号的映射
+	txSeqs map[uint32]int
+	// txStamps 探测包的内核发送时间戳
+	txStamps map[int]kernelStamp
+	// sendBuf 手动填写IP首部时复用的发送缓冲区
+	sendBuf []byte
+	// mtu 手动填写IP首部时出接口的MTU，超过时自己分片，为0表示不分片
+	mtu int
+	// responders 广播和组播ping的应答者，按照第一次应答的先后排列
+	responders []*responder
+	// responderIndex 应答者地址到应答者的映射
+	responderIndex map[string]*responder
+}
+
+// SetPrivileged 设置是否使用特权模式。特权模式使用原始套接字并手动填写IP首部，
+// 需要root或者CAP_NET_RAW权限；非特权模式使用Linux的ICMP数据报套接字，
+// 需要当前用户组在net.ipv4.ping_group_range范围内
+func (p *Pinger) SetPrivileged(privileged bool) {
+	if privileged {
+		p.protocol = "icmp"
+	} else {
+		p.protocol = "udp"
+	}
+}
+
+// Privileged 是否为特权模式
+func (p *Pinger) Privileged() bool {
+	return p.protocol == "icmp"
 }
 
 // Resolve 解析目的地址，如果是域名会由做域名解析
@@ -117,16 +240,38 @@ func (p *Pinger) Resolve() error {
 	if err != nil {
 		return err
 	}
-	// 是否是ipv4
-	if len(ipaddr.IP.To4()) != net.IPv4len {
-		panic("only support IPv4")
-	}
+	p.ipv4 = isIPv4(ipaddr.IP)
 	p.TargetIpaddr = ipaddr
 	return nil
 }
 
+// SetNetwork 设置解析目的地址时使用的网络，"ip4"只解析IPv4地址，"ip6"只解析IPv6地址，
+// 其他值等同于"ip"，IPv4与IPv6均可。修改后Run会重新解析目的地址
+func (p *Pinger) SetNetwork(n string) {
+	switch n {
+	case "ip4", "ip6":
+		p.network = n
+	default:
+		p.network = "ip"
+	}
+	p.TargetIpaddr = nil
+}
+
+// isIPv4 是否是ipv4
+func isIPv4(ip net.IP) bool {
+	return len(ip.To4()) == net.IPv4len
+}
+
 // Run 开始ping操作，会阻塞，可以使用Stop方法停止
 func (p *Pinger) Run() error {
+	return p.RunWithContext(context.Background())
+}
+
+// RunWithContext 与Run相同，ctx被取消时停止并返回ctx.Err()。
+// 无论以何种方式停止，退出前都会关闭套接字并触发OnFinish
+func (p *Pinger) RunWithContext(ctx context.Context) error {
+	done, endRun := startRun(&p.lock, &p.done)
+	defer endRun()
 	var err error
 	if p.TargetIpaddr == nil {
 		err = p.Resolve()
@@ -134,131 +279,614 @@ func (p *Pinger) Run() error {
 	if err != nil {
 		return err
 	}
-	// 建立原始套接字
-	sock := 0
-	sock, err = unix.Socket(unix.AF_INET, unix.SOCK_RAW, unix.IPPROTO_ICMP)
+	err = p.checkInterval()
+	if err != nil {
+		return err
+	}
+	err = p.checkMarking()
+	if err != nil {
+		return err
+	}
+	err = p.checkProbeType()
+	if err != nil {
+		return err
+	}
+	err = p.checkSize()
 	if err != nil {
-		fmt.Println(fmt.Sprintf("Create socket error:%s", err.Error()))
 		return err
 	}
-	// 设置为手动写入ip首部
-	err = unix.SetsockoptInt(sock, unix.IPPROTO_IP, unix.IP_HDRINCL, 1)
+	err = p.checkBroadcast()
 	if err != nil {
-		fmt.Println(fmt.Sprintf("Set socket IP_HDRINCL error:%s", err.Error()))
 		return err
 	}
-	// 解析本地源IP地址
-	p.SourceAddr = "192.168.0.101"
-	p.SourceIpAddr, err = net.ResolveIPAddr(p.network, p.SourceAddr)
+	err = p.checkBinding()
 	if err != nil {
-		fmt.Println(fmt.Sprintf("ResolveIPAddr SourceAddr:%s error:%s", p.SourceAddr, err.Error()))
 		return err
 	}
-	sa := &unix.SockaddrInet4{}
-	copy(sa.Addr[:], p.SourceIpAddr.IP)
-	// 绑定本地源IP地址
-	err = unix.Bind(sock, sa)
+	p.ipOptions, err = buildIPv4Options(p.RecordRoute, p.Timestamp)
+	if err != nil {
+		return err
+	}
+	if !p.ipv4 && p.ipOptions != nil {
+		return errors.New("IP options are only supported for IPv4")
+	}
+	conn, err := p.listen()
+	if err != nil {
+		return err
+	}
+	// connect方式的TCP探测不需要套接字
+	if conn != nil {
+		defer conn.close()
+	}
+	r, err := newReceiver()
 	if err != nil {
-		fmt.Println(fmt.Sprintf("Bind SourceAddr:%s error:%s", p.SourceIpAddr.String(), err.Error()))
 		return err
 	}
 
 	if handler := p.OnSetup; handler != nil {
 		handler()
 	}
-	err = p.sendICMP(sock)
+	defer p.finish()
+
+	if conn != nil {
+		r.start(conn)
+	}
+	// 先停止接收协程再关闭套接字
+	defer r.stop()
+	// 在r.stop等待之前取消还在进行的connect
+	probeCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	timeout := time.NewTimer(p.Timeout)
+	defer timeout.Stop()
+
+	err = p.sendProbe(probeCtx, conn, r)
 	if err != nil {
 		return err
 	}
+	lastSend := time.Now()
+	send := time.NewTimer(p.sendDelay())
+	defer send.Stop()
 	for {
-		data, err := p.recvICMP(sock)
-		if err != nil {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-done:
+			return nil
+		case <-timeout.C:
+			return nil
+		case err = <-r.errs:
 			return err
-		}
-		if data.IPv4Header.Src.String() == p.TargetIpaddr.String() {
-			if data.ICMPData.Type == ipv4.ICMPTypeEchoReply {
-				fmt.Println(fmt.Sprintf("ip:%s reply", data.IPv4Header.Src.String()))
-				break
+		case data := <-r.recv:
+			recv := p.PacketsRecv
+			p.processPacket(data)
+			if p.PacketsRecv > recv && (p.Flood || p.Adaptive) && !p.sentAll() {
+				// 泛洪模式收到应答后立即发送下一个请求，自适应模式按照新的RTT重新计算间隔，
+				// 两者都不能早于最小间隔
+				wait := p.minInterval()
+				if p.Adaptive {
+					wait = p.nextInterval()
+				}
+				resetTimer(send, wait-time.Since(lastSend))
+			}
+		case <-send.C:
+			// 发完Count个包后已经等待了Wait或ReplyTimeout
+			if p.sentAll() {
+				return nil
+			}
+			err = p.sendProbe(probeCtx, conn, r)
+			if err != nil {
+				return err
 			}
-		} else {
-			fmt.Println(fmt.Sprintf("other data ip:%s type:%d", data.IPv4Header.Src.String(), data.IPv4Header.Protocol))
+			lastSend = time.Now()
+			resetTimer(send, p.sendDelay())
+		}
+		if p.Count > 0 && p.PacketsRecv >= p.Count {
+			return nil
+		}
+	}
+}
+
+// sentAll 是否已经发完Count个包
+func (p *Pinger) sentAll() bool {
+	return p.Count > 0 && p.PacketsSent >= p.Count
+}
+
+// sendDelay 距离下次发包的时间，发完Count个包后为等待剩余应答的时间
+func (p *Pinger) sendDelay() time.Duration {
+	if p.sentAll() {
+		if p.ReplyTimeout > 0 && p.ReplyTimeout < p.Wait {
+			return p.ReplyTimeout
+		}
+		return p.Wait
+	}
+	return p.nextInterval()
+}
+
+// checkSize 检查负载大小是否能容纳匹配应答所需的内容，TCP探测不携带负载
+func (p *Pinger) checkSize() error {
+	switch p.ProbeType {
+	case ProbeTCP:
+		return nil
+	case ProbeUDP:
+		if p.Size < udpSeqLen {
+			return fmt.Errorf("packet size %d is too small, at least %d bytes are needed for the sequence", p.Size, udpSeqLen)
+		}
+	default:
+		if p.Size < timeSliceLength+trackerLength {
+			return fmt.Errorf("packet size %d is too small, at least %d bytes are needed for the send time and tracker",
+				p.Size, timeSliceLength+trackerLength)
+		}
+	}
+	return nil
+}
+
+// checkInterval 检查发包间隔，与iputils ping相同，非root用户不能使用泛洪模式，
+// 间隔（包括自适应模式）不能小于minUserInterval
+func (p *Pinger) checkInterval() error {
+	if p.Flood && p.Adaptive {
+		return errors.New("flood and adaptive modes cannot be used together")
+	}
+	if p.Flood && !isSuperUser() {
+		return fmt.Errorf("cannot flood; minimal interval allowed for user is %v", minUserInterval)
+	}
+	if p.Interval <= 0 && !p.Flood {
+		return fmt.Errorf("invalid interval %v", p.Interval)
+	}
+	if !isSuperUser() && p.Interval < minUserInterval {
+		return fmt.Errorf("minimal interval allowed for user is %v", minUserInterval)
+	}
+	return nil
+}
+
+// minInterval 两次发包的最小间隔，root用户不限制
+func (p *Pinger) minInterval() time.Duration {
+	if isSuperUser() {
+		return 0
+	}
+	return minUserInterval
+}
+
+// nextInterval 距离下一次发包的时间
+func (p *Pinger) nextInterval() time.Duration {
+	var interval time.Duration
+	switch {
+	case p.Flood:
+		// 没有应答时至少每floodInterval发送一次，Interval更小时按照Interval发送
+		interval = floodInterval
+		if p.Interval > 0 && p.Interval < floodInterval {
+			interval = p.Interval
+		}
+	case p.Adaptive:
+		// 间隔等于平滑后的RTT，网络中基本上只有一个没有应答的请求
+		interval = p.Interval
+		if p.srtt > 0 {
+			interval = p.srtt
+		}
+	default:
+		return p.Interval
+	}
+	return max(interval, p.minInterval())
+}
+
+// updateSrtt 按照TCP的方式平滑RTT，新样本的权重为1/8
+func (p *Pinger) updateSrtt(rtt time.Duration) {
+	if p.srtt == 0 {
+		p.srtt = rtt
+		return
+	}
+	p.srtt += (rtt - p.srtt) / 8
+}
+
+// resetTimer 停止t并清空其中未读取的事件后重新设置，d小于0时立即触发
+func resetTimer(t *time.Timer, d time.Duration) {
+	if !t.Stop() {
+		select {
+		case <-t.C:
+		default:
+		}
+	}
+	t.Reset(max(d, 0))
+}
+
+// isSuperUser 当前进程是否以root运行
+func isSuperUser() bool {
+	return unix.Geteuid() == 0
+}
+
+// checkMarking 检查探测包的TTL、DSCP和ECN
+func (p *Pinger) checkMarking() error {
+	if p.TTL < 1 || p.TTL > math.MaxUint8 {
+		return fmt.Errorf("invalid TTL %d", p.TTL)
+	}
+	if p.DSCP < 0 || p.DSCP > 63 {
+		return fmt.Errorf("invalid DSCP %d", p.DSCP)
+	}
+	if p.ECN < 0 || p.ECN > 3 {
+		return fmt.Errorf("invalid ECN %d", p.ECN)
+	}
+	return nil
+}
+
+// checkProbeType 检查探测包的类型和TCP、UDP探测的端口
+func (p *Pinger) checkProbeType() error {
+	switch p.ProbeType {
+	case ProbeICMP:
+		return nil
+	case ProbeTCP, ProbeUDP:
+		if p.Port < 0 || p.Port > math.MaxUint16 {
+			return fmt.Errorf("invalid port %d", p.Port)
+		}
+		if p.ProbeType == ProbeTCP && p.Port == 0 {
+			p.Port = defaultTCPPort
+		}
+		return nil
+	}
+	return fmt.Errorf("unsupported probe type %d", p.ProbeType)
+}
+
+// sendProbe 按照探测包的类型发送一个请求
+func (p *Pinger) sendProbe(ctx context.Context, conn *icmpConn, r *receiver) error {
+	seq := p.sequence
+	// 序号重新使用时丢弃之前的发送时间戳
+	delete(p.txStamps, seq)
+	var sends uint32
+	if conn != nil {
+		sends = conn.sends
+	}
+	var err error
+	switch {
+	case p.ProbeType == ProbeUDP:
+		err = p.sendUDP(conn)
+	case p.ProbeType == ProbeTCP && conn != nil:
+		err = p.sendTCP(conn)
+	case p.ProbeType == ProbeTCP:
+		p.connectTCP(ctx, r)
+		return nil
+	default:
+		err = p.sendICMP(conn)
+	}
+	if err != nil {
+		return err
+	}
+	p.recordTxKeys(conn, seq, sends)
+	return nil
+}
+
+// tos 探测包的TOS，IPv6为流量类别
+func (p *Pinger) tos() int {
+	return p.DSCP<<2 | p.ECN
+}
+
+// Stop 停止正在运行的Run，可以在任意协程中多次调用。没有在运行时什么也不做，
+// 不会影响之后的Run
+func (p *Pinger) Stop() {
+	stopRun(&p.lock, &p.done)
+}
+
+// startRun 在lock保护下为一次Run新建停止信号并保存到done，返回的函数在Run结束时清除它
+func startRun(lock *sync.Mutex, done *chan struct{}) (chan struct{}, func()) {
+	ch := make(chan struct{})
+	lock.Lock()
+	*done = ch
+	lock.Unlock()
+	return ch, func() {
+		lock.Lock()
+		if *done == ch {
+			*done = nil
 		}
+		lock.Unlock()
+	}
+}
+
+// stopRun 在lock保护下关闭正在进行的Run的停止信号
+func stopRun(lock *sync.Mutex, done *chan struct{}) {
+	lock.Lock()
+	defer lock.Unlock()
+
+	if *done == nil {
+		return
+	}
+	select {
+	case <-*done:
+	default:
+		close(*done)
 	}
-	return err
 }
 
-func (p *Pinger) sendICMP(sock int) error {
+// processPacket 处理收到的数据包，只关心发给本Pinger的echo应答和有关的差错报文
+func (p *Pinger) processPacket(recv *recvPacket) {
+	data := recv.data
+	switch data := data.(type) {
+	case *tcpSegment:
+		p.processTCP(data, recv)
+		return
+	case *udpDatagram:
+		p.processUDP(data, recv)
+		return
+	case *txTimestamp:
+		p.processTxTimestamp(data)
+		return
+	}
+	if p.ProbeType == ProbeUDP {
+		p.processUDPError(recv)
+		return
+	}
+	msg := data.message()
+	if msg.Type != p.echoReplyType() {
+		p.processError(recv)
+		return
+	}
+	// 广播和组播的应答来自各个应答者
+	if !p.multiResponder() && !data.src().Equal(p.TargetIpaddr.IP) {
+		return
+	}
+	echo, ok := msg.Body.(*icmp.Echo)
+	if !ok || echo.ID != p.id {
+		return
+	}
+
+	// 负载中携带发送时间和tracker，tracker不属于本Pinger的是其他Pinger的应答
+	payloadSentAt, trackerUUID, ok := parsePayload(echo.Data)
+	if !ok || !p.hasTracker(trackerUUID) {
+		return
+	}
+	rtt, ok := p.localRtt(echo.Seq, payloadSentAt, recv.receivedAt)
+	if !ok {
+		return
+	}
+
+	pkt := &Packet{
+		Rtt:    rtt,
+		IPAddr: p.TargetIpaddr,
+		Addr:   p.TargetAddr,
+		Nbytes: data.icmpLen(),
+		Seq:    echo.Seq,
+		Ttl:    data.hopLimit(),
+		Tos:    data.trafficClass(),
+		ID:     echo.ID,
+	}
+	if p.multiResponder() {
+		pkt.IPAddr = p.responderAddr(data.src())
+	}
+	if v4, ok := data.(*ICMPv4Data); ok {
+		pkt.Options = parseIPv4Options(v4.IPv4Header.Options)
+	}
+
+	p.stampRtt(pkt, recv)
+	p.recordReply(trackerUUID, pkt)
+}
+
+// recordReply 统计一个应答，第一次收到的应答计入统计信息，之后的计为重复。
+// 超过ReplyTimeout的应答视为该请求已经丢失，不计入统计
+func (p *Pinger) recordReply(trackerUUID uuid.UUID, pkt *Packet) {
+	if _, inflight := p.awaitingSequences[trackerUUID][pkt.Seq]; inflight {
+		delete(p.awaitingSequences[trackerUUID], pkt.Seq)
+		if p.ReplyTimeout > 0 && pkt.Rtt > p.ReplyTimeout {
+			return
+		}
+		dscp := pkt.Tos >> 2
+		p.lock.Lock()
+		p.PacketsRecv++
+		if p.RecordRtts {
+			p.rtts = append(p.rtts, pkt.Rtt)
+		}
+		p.rttStats.add(pkt.Rtt)
+		p.histogram.Record(pkt.Rtt)
+		p.jitter.add(pkt.Rtt)
+		if p.dscpStats[dscp] == nil {
+			p.dscpStats[dscp] = &rttStats{}
+		}
+		p.dscpStats[dscp].add(pkt.Rtt)
+		if p.multiResponder() {
+			p.recordResponder(pkt)
+		}
+		p.lock.Unlock()
+		p.updateSrtt(pkt.Rtt)
+		if handler := p.OnRecv; handler != nil {
+			handler(pkt)
+		}
+		return
+	}
+	p.lock.Lock()
+	p.PacketsRecvDuplicates++
+	if p.multiResponder() {
+		p.recordResponder(pkt)
+	}
+	p.lock.Unlock()
+	if handler := p.OnDuplicateRecv; handler != nil {
+		handler(pkt)
+	}
+}
+
+// processError 处理差错报文，根据其中引用的echo请求判断是否由本Pinger发出
+func (p *Pinger) processError(recv *recvPacket) {
+	data := recv.data
+	quoted, icmpErr := decodeICMPError(data)
+	if icmpErr == nil {
+		return
+	}
+	dst, echo, ok := quotedEcho(quoted, p.ipv4)
+	if !ok || !dst.Equal(p.TargetIpaddr.IP) || echo.ID != p.id {
+		return
+	}
+	// 引用的数据报可能被截断，带有tracker时才能排除其他Pinger的请求并计算RTT
+	pkt := &Packet{
+		IPAddr: p.TargetIpaddr,
+		Addr:   p.TargetAddr,
+		Nbytes: data.icmpLen(),
+		Seq:    echo.Seq,
+		Ttl:    data.hopLimit(),
+		ID:     echo.ID,
+	}
+	if payloadSentAt, trackerUUID, ok := parsePayload(echo.Data); ok {
+		if !p.hasTracker(trackerUUID) {
+			return
+		}
+		pkt.Rtt, _ = p.localRtt(echo.Seq, payloadSentAt, recv.receivedAt)
+	}
+	p.stampRtt(pkt, recv)
+	p.reportError(pkt, icmpErr)
+}
+
+// localRtt 根据本地记录的发送时间计算序号为seq的请求的RTT。负载中的发送时间只用来确认
+// 应答对应的是该序号最近一次发出的请求，RTT按照单调时钟计算，不受系统时间调整的影响
+func (p *Pinger) localRtt(seq int, payloadSentAt, receivedAt time.Time) (time.Duration, bool) {
+	sentAt, ok := p.sentAt[seq]
+	if !ok || sentAt.UnixNano() != payloadSentAt.UnixNano() {
+		return 0, false
+	}
+	return receivedAt.Sub(sentAt), true
+}
+
+// reportError 统计差错并触发OnError
+func (p *Pinger) reportError(pkt *Packet, icmpErr error) {
+	// 重定向只是建议更换下一跳，请求已经被转发
+	if _, redirect := icmpErr.(*RedirectError); !redirect {
+		p.lock.Lock()
+		p.PacketsErrors++
+		p.lock.Unlock()
+	}
+	if handler := p.OnError; handler != nil {
+		handler(pkt, icmpErr)
+	}
+}
+
+func (p *Pinger) sendICMP(conn *icmpConn) error {
+	currentUUID := p.trackerUUIDs[len(p.trackerUUIDs)-1]
+	sentAt := time.Now()
+	payload := makePayload(sentAt, currentUUID, p.Size)
 	icmpData := &icmp.Message{
-		Type:     ipv4.ICMPTypeEcho,
+		Type:     p.echoRequestType(),
 		Code:     0,
 		Checksum: 0,
 		Body: &icmp.Echo{
-			ID:   0,
-			Seq:  0,
-			Data: nil,
+			ID:   p.id,
+			Seq:  p.sequence,
+			Data: payload,
 		},
 	}
-	buff, err := icmpData.Marshal(nil)
+	var err error
+	if conn.ipv4 && conn.privileged {
+		err = p.sendIPv4(conn, icmpData)
+	} else {
+		// 数据报套接字和IPv6套接字只需要写入ICMP报文，
+		// 数据报套接字的ID由内核填写，ICMPv6的校验和由内核计算
+		var buff []byte
+		buff, err = icmpData.Marshal(nil)
+		if err == nil {
+			err = conn.sendMarked(buff, sockaddr(p.TargetIpaddr), p.TTL, p.tos())
+		}
+	}
 	if err != nil {
 		return err
 	}
+	p.sentAt[p.sequence] = sentAt
+	p.markSent(icmpEchoHeaderLen + len(payload))
+	return nil
+}
+
+// markSent 记录已经发出的探测包并更新序号
+func (p *Pinger) markSent(nbytes int) {
+	currentUUID := p.trackerUUIDs[len(p.trackerUUIDs)-1]
+	p.awaitingSequences[currentUUID][p.sequence] = struct{}{}
+	if handler := p.OnSend; handler != nil {
+		handler(&Packet{
+			IPAddr: p.TargetIpaddr,
+			Addr:   p.TargetAddr,
+			Nbytes: nbytes,
+			Seq:    p.sequence,
+			Ttl:    p.TTL,
+			ID:     p.id,
+		})
+	}
+	p.lock.Lock()
+	p.PacketsSent++
+	p.resetResponders(p.sequence)
+	p.lock.Unlock()
+	p.sequence++
+	// 序号用完后换一个新的tracker重新计数
+	if p.sequence > math.MaxUint16 {
+		newUUID := uuid.New()
+		p.trackerUUIDs = append(p.trackerUUIDs, newUUID)
+		p.awaitingSequences[newUUID] = make(map[int]struct{})
+		p.sequence = 0
+		// 只保留最近的maxTrackers个tracker，长时间运行时没有应答的序号不会一直累积
+		if len(p.trackerUUIDs) > maxTrackers {
+			delete(p.awaitingSequences, p.trackerUUIDs[0])
+			p.trackerUUIDs = p.trackerUUIDs[1:]
+		}
+	}
+}
+
+// hasTracker tracker是否由本Pinger生成
+func (p *Pinger) hasTracker(tracker uuid.UUID) bool {
+	for _, trackerUUID := range p.trackerUUIDs {
+		if trackerUUID == tracker {
+			return true
+		}
+	}
+	return false
+}
+
+// sendIPv4 手动填写IP首部后发送ICMP报文，报文写入复用的发送缓冲区
+func (p *Pinger) sendIPv4(conn *icmpConn, icmpData *icmp.Message) error {
 	data := &ICMPv4Data{
 		IPv4Header: &ipv4.Header{
-			Version: ipv4.Version,
-			Len:     ipv4.HeaderLen, // IP头长一般是20
-			TOS:     0x00,
-			//buff为数据
-			TotalLen: ipv4.HeaderLen + len(buff),
-			TTL:      64,
-			Flags:    ipv4.DontFragment, // 不分片
-			FragOff:  0,
-			Protocol: unix.IPPROTO_ICMP,
-			Checksum: 0,
-			Src:      p.SourceIpAddr.IP,
-			Dst:      p.TargetIpaddr.IP,
+			TOS:     p.tos(),
+			TTL:     p.TTL,
+			Flags:   ipv4.DontFragment, // 不超过出接口MTU时不分片
+			FragOff: 0,
+			Src:     p.SourceIpAddr.IP,
+			Dst:     p.TargetIpaddr.IP,
+			Options: p.ipOptions, // 携带选项时IP首部长于20字节
 		},
 		ICMPData: icmpData,
 	}
-	marshal, err := data.Marshal()
-	if err != nil {
-		return err
+	n := data.MarshalLen()
+	if cap(p.sendBuf) < n {
+		p.sendBuf = make([]byte, n)
+	}
+	fragment := p.mtu > 0 && n > p.mtu
+	if fragment {
+		// 超过出接口MTU时清除DF自己分片，所有分片需要相同且不为0的ID，不分片时为0，由内核填写
+		data.IPv4Header.Flags = 0
+		data.IPv4Header.ID = (p.id+p.sequence)%math.MaxUint16 + 1
 	}
-	// 解析目的IP地址
-	peer, err := net.ResolveIPAddr(p.network, p.TargetAddr)
+	n, err := data.MarshalTo(p.sendBuf[:cap(p.sendBuf)])
 	if err != nil {
-		fmt.Println(fmt.Sprintf("ResolveIPAddr TargetAddr:%s error:%s", p.TargetAddr, err.Error()))
 		return err
 	}
-	sa := &unix.SockaddrInet4{}
-	copy(sa.Addr[:], peer.IP)
-	err = unix.Sendto(sock, marshal, 0, sa)
+	if !fragment {
+		return conn.sendTo(p.sendBuf[:n], p.TargetIpaddr)
+	}
+	fragments, err := fragmentIPv4(p.sendBuf[:n], p.mtu)
 	if err != nil {
 		return err
 	}
+	for _, b := range fragments {
+		err = conn.sendTo(b, p.TargetIpaddr)
+		if err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
-func (p *Pinger) recvICMP(sock int) (*ICMPv4Data, error) {
-	for {
-		select {
-		default:
-			bytes := make([]byte, 4096)
-			n, _, err := unix.Recvfrom(sock, bytes, 0)
-			if err != nil {
-				continue
-			}
-			data := &ICMPv4Data{
-				IPv4Header: &ipv4.Header{},
-				ICMPData:   nil,
-			}
-			// 解析icmp报文
-			err = data.Unmarshal(bytes[:n])
-			if err != nil {
-				return nil, err
-			}
-			return data, nil
-		}
+// echoRequestType 根据目的地址的协议族返回回显请求的类型
+func (p *Pinger) echoRequestType() icmp.Type {
+	if p.ipv4 {
+		return ipv4.ICMPTypeEcho
+	}
+	return ipv6.ICMPTypeEchoRequest
+}
+
+// echoReplyType 根据目的地址的协议族返回回显应答的类型
+func (p *Pinger) echoReplyType() icmp.Type {
+	if p.ipv4 {
+		return ipv4.ICMPTypeEchoReply
 	}
+	return ipv6.ICMPTypeEchoReply
 }
 
 var seed int64 = time.Now().UnixNano()
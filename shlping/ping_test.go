@@ -0,0 +1,46 @@
+package shlping
+
+import (
+	"testing"
+	"time"
+)
+
+func TestPingerCheckInterval(t *testing.T) {
+	tests := []struct {
+		name     string
+		interval time.Duration
+		flood    bool
+		adaptive bool
+		// wantErrRoot、wantErrUser 分别为root和非root用户是否应当出错
+		wantErrRoot bool
+		wantErrUser bool
+	}{
+		{name: "default", interval: time.Second},
+		{name: "minimal user interval", interval: minUserInterval},
+		{name: "below minimal user interval", interval: time.Millisecond, wantErrUser: true},
+		{name: "zero interval", interval: 0, wantErrRoot: true, wantErrUser: true},
+		{name: "negative interval", interval: -time.Second, wantErrRoot: true, wantErrUser: true},
+		{name: "flood", interval: time.Second, flood: true, wantErrUser: true},
+		{name: "flood without interval", interval: 0, flood: true, wantErrUser: true},
+		{name: "adaptive", interval: time.Second, adaptive: true},
+		{name: "adaptive below minimal user interval", interval: time.Millisecond, adaptive: true, wantErrUser: true},
+		{name: "adaptive without interval", interval: 0, adaptive: true, wantErrRoot: true, wantErrUser: true},
+		{name: "flood and adaptive", interval: time.Second, flood: true, adaptive: true, wantErrRoot: true, wantErrUser: true},
+	}
+	wantErr := func(root, user bool) bool {
+		if isSuperUser() {
+			return root
+		}
+		return user
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := newPinger("127.0.0.1")
+			p.Interval, p.Flood, p.Adaptive = tt.interval, tt.flood, tt.adaptive
+			err := p.checkInterval()
+			if (err != nil) != wantErr(tt.wantErrRoot, tt.wantErrUser) {
+				t.Errorf("checkInterval() = %v, superuser %v", err, isSuperUser())
+			}
+		})
+	}
+}
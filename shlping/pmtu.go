@@ -0,0 +1,300 @@
+package shlping
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/sys/unix"
+	"net"
+	"time"
+)
+
+const (
+	// minIPv4MTU IPv4要求所有链路至少支持的MTU（RFC 791）
+	minIPv4MTU = 68
+	// maxIPv4MTU IPv4数据报的最大长度
+	maxIPv4MTU = 65535
+)
+
+// PMTUResult 路径MTU发现的结果
+type PMTUResult struct {
+	// MTU 路径MTU，即不分片能够到达目的地址的最大IP数据报长度
+	MTU int
+	// Hop 降低MTU的跳，0表示本机出接口，-1表示无法确定
+	Hop int
+	// HopAddr 降低MTU的路由器地址：发送需要分片报文的路由器，
+	// 或者黑洞之前最后一个应答的路由器；Hop为0时是本机的源地址
+	HopAddr *net.IPAddr
+	// BlackHole 路径上是否存在丢弃大包却不返回需要分片报文的黑洞
+	BlackHole bool
+}
+
+// pmtuReply 一次探测的应答
+type pmtuReply struct {
+	// from 应答的地址
+	from *net.IPAddr
+	// reached 探测包到达了目的地址
+	reached bool
+	// timeExceeded 探测包在途中TTL耗尽
+	timeExceeded bool
+	// tooBig 收到需要分片报文，或者本机发送时就超过了出接口MTU
+	tooBig bool
+	// nextHopMTU 需要分片报文中给出的下一跳MTU
+	nextHopMTU int
+	// hop 根据引用的原始IP首部中剩余的TTL推算出的应答所在跳数
+	hop int
+}
+
+// PMTUProber 路径MTU发现。设置DF标志后二分查找能够到达目的地址的最大包长，
+// 根据路由器返回的需要分片报文中的下一跳MTU缩小范围，多次超时视为被黑洞丢弃。
+// 目的地址、源地址、探测类型以及作为单个探测超时时间的Timeout与Tracer相同，
+// 查找黑洞位置时使用FirstTTL和MaxTTL
+type PMTUProber struct {
+	*Tracer
+	// MinMTU 查找的下限，默认为68
+	MinMTU int
+	// MaxMTU 查找的上限，为0时使用出接口的MTU
+	MaxMTU int
+	// Retries 每个大小的探测次数，全部超时才认为该大小被丢弃，默认为2
+	Retries int
+}
+
+// NewPMTUProber 新建一个PMTUProber
+func NewPMTUProber(addr string) (*PMTUProber, error) {
+	tracer, err := NewTracer(addr)
+	if err != nil {
+		return nil, err
+	}
+	tracer.ProbeType = ProbeICMP
+	tracer.Timeout = time.Second
+	return &PMTUProber{
+		Tracer:  tracer,
+		MinMTU:  minIPv4MTU,
+		Retries: 2,
+	}, nil
+}
+
+// Run 开始路径MTU发现
+func (p *PMTUProber) Run() (*PMTUResult, error) {
+	return p.RunWithContext(context.Background())
+}
+
+// RunWithContext 与Run相同，ctx被取消时返回ctx.Err()
+func (p *PMTUProber) RunWithContext(ctx context.Context) (*PMTUResult, error) {
+	var err error
+	if p.TargetIpaddr == nil {
+		err = p.Resolve()
+	}
+	if err != nil {
+		return nil, err
+	}
+	err = p.checkProbeType()
+	if err != nil {
+		return nil, err
+	}
+	p.SourceIpAddr, err = selectSource(p.network, p.SourceAddr, p.TargetIpaddr, 0)
+	if err != nil {
+		return nil, err
+	}
+	maxMTU := p.MaxMTU
+	if maxMTU == 0 {
+		maxMTU, err = interfaceMTU(p.SourceIpAddr.IP)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if maxMTU > maxIPv4MTU {
+		maxMTU = maxIPv4MTU
+	}
+	conn, err := p.listen()
+	if err != nil {
+		return nil, err
+	}
+	defer conn.close()
+	// 忽略内核缓存的路径MTU，否则之前收到的需要分片报文会让大包在本机发送时就失败
+	err = unix.SetsockoptInt(conn.fd, unix.IPPROTO_IP, unix.IP_MTU_DISCOVER, unix.IP_PMTUDISC_PROBE)
+	if err != nil {
+		fmt.Println(fmt.Sprintf("Set socket IP_MTU_DISCOVER error:%s", err.Error()))
+		return nil, err
+	}
+	r, err := newReceiver()
+	if err != nil {
+		return nil, err
+	}
+	r.start(conn)
+	defer r.stop()
+
+	// 先确认最小的包能够到达目的地址
+	reply, err := p.probe(ctx, conn, r, p.MinMTU, defaultTTL)
+	if err != nil {
+		return nil, err
+	}
+	if reply == nil || !reply.reached {
+		return nil, fmt.Errorf("%s does not answer %d-byte probes", p.TargetIpaddr, p.MinMTU)
+	}
+
+	result := &PMTUResult{Hop: 0, HopAddr: p.SourceIpAddr}
+	lo, hi := p.MinMTU, maxMTU
+	// dropped 最近一次被静默丢弃的大小，为0表示上限不是由黑洞决定的
+	dropped := 0
+	for lo < hi {
+		mid := (lo + hi + 1) / 2
+		reply, err = p.probe(ctx, conn, r, mid, defaultTTL)
+		if err != nil {
+			return nil, err
+		}
+		switch {
+		case reply == nil:
+			hi = mid - 1
+			dropped = mid
+		case reply.reached:
+			lo = mid
+		case reply.tooBig:
+			hi = mid - 1
+			// 路由器给出了下一跳MTU时直接跳到该值
+			if reply.nextHopMTU >= lo && reply.nextHopMTU < mid {
+				hi = reply.nextHopMTU
+			}
+			dropped = 0
+			result.Hop = reply.hop
+			result.HopAddr = reply.from
+		default:
+			return nil, fmt.Errorf("unexpected ICMP reply from %s while probing %d bytes", reply.from, mid)
+		}
+	}
+	result.MTU = lo
+	if dropped == 0 {
+		return result, nil
+	}
+
+	result.BlackHole = true
+	result.Hop, result.HopAddr, err = p.locateBlackHole(ctx, conn, r, dropped)
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// locateBlackHole 以被丢弃的大小逐跳增加TTL探测，大包仍能在某一跳触发TTL超时说明
+// 已经通过了该跳，第一个没有应答的TTL之前的路由器就是丢弃大包的位置
+func (p *PMTUProber) locateBlackHole(ctx context.Context, conn *icmpConn, r *receiver, size int) (int, *net.IPAddr, error) {
+	var last *net.IPAddr
+	for ttl := p.FirstTTL; ttl <= p.MaxTTL; ttl++ {
+		reply, err := p.probe(ctx, conn, r, size, ttl)
+		if err != nil {
+			return -1, nil, err
+		}
+		if reply == nil {
+			return ttl - 1, last, nil
+		}
+		if !reply.timeExceeded {
+			break
+		}
+		last = reply.from
+	}
+	return -1, nil, nil
+}
+
+// probe 发送size字节（包含IP首部）并设置DF的探测包，最多重试Retries次，全部超时返回nil
+func (p *PMTUProber) probe(ctx context.Context, conn *icmpConn, r *receiver, size, ttl int) (*pmtuReply, error) {
+	payload := size - ipv4.HeaderLen - icmpEchoHeaderLen
+	if p.ProbeType == ProbeUDP {
+		payload = size - ipv4.HeaderLen - udpHeaderLen
+	}
+	if payload < 0 {
+		return nil, fmt.Errorf("probe size %d too small", size)
+	}
+	for i := 0; i < p.Retries; i++ {
+		seq := p.nextSequence()
+		err := p.sendProbe(conn, ttl, seq, payload, ipv4.DontFragment)
+		if errors.Is(err, unix.EMSGSIZE) {
+			// 超过了本机出接口的MTU
+			return &pmtuReply{from: p.SourceIpAddr, tooBig: true}, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		reply, err := p.waitReply(ctx, r, seq, ttl)
+		if err != nil || reply != nil {
+			return reply, err
+		}
+	}
+	return nil, nil
+}
+
+// waitReply 等待序号为seq的探测包的应答，超时返回nil
+func (p *PMTUProber) waitReply(ctx context.Context, r *receiver, seq, ttl int) (*pmtuReply, error) {
+	timeout := time.NewTimer(p.Timeout)
+	defer timeout.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-timeout.C:
+			return nil, nil
+		case err := <-r.errs:
+			return nil, err
+		case recv := <-r.recv:
+			if got, ok := p.matchProbe(recv.data); !ok || got != seq {
+				continue
+			}
+			reply := &pmtuReply{from: &net.IPAddr{IP: append(net.IP(nil), recv.data.src()...)}}
+			if recv.data.src().Equal(p.TargetIpaddr.IP) {
+				reply.reached = true
+				return reply, nil
+			}
+			data, ok := recv.data.(*ICMPv4Data)
+			if !ok {
+				continue
+			}
+			switch data.ICMPData.Type {
+			case ipv4.ICMPTypeTimeExceeded:
+				reply.timeExceeded = true
+			case ipv4.ICMPTypeDestinationUnreachable:
+				reply.tooBig = data.ICMPData.Code == 4
+				reply.nextHopMTU = data.NextHopMTU()
+			}
+			reply.hop = quotedHop(data.ICMPData, ttl)
+			return reply, nil
+		}
+	}
+}
+
+// quotedHop 路由器引用的原始IP首部中是到达它时剩余的TTL，据此推算它所在的跳数
+func quotedHop(msg *icmp.Message, ttl int) int {
+	var quoted []byte
+	switch body := msg.Body.(type) {
+	case *icmp.TimeExceeded:
+		quoted = body.Data
+	case *icmp.DstUnreach:
+		quoted = body.Data
+	}
+	header, _, err := parseQuotedIPv4(quoted)
+	// 从UDP套接字的错误队列中取出的差错没有原始的IP首部，TTL为0
+	if err != nil || header.TTL == 0 || header.TTL > ttl {
+		return -1
+	}
+	return ttl - header.TTL + 1
+}
+
+// interfaceMTU 查找地址为ip的网口的MTU
+func interfaceMTU(ip net.IP) (int, error) {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return 0, err
+	}
+	for _, ifi := range ifaces {
+		addrs, err := ifi.Addrs()
+		if err != nil {
+			continue
+		}
+		for _, addr := range addrs {
+			if ipnet, ok := addr.(*net.IPNet); ok && ipnet.IP.Equal(ip) {
+				return ifi.MTU, nil
+			}
+		}
+	}
+	return 0, fmt.Errorf("no interface has address %s", ip)
+}
@@ -0,0 +1,729 @@
+package shlping
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+	"golang.org/x/sys/unix"
+	"net"
+	"sync"
+	"time"
+	"unsafe"
+)
+
+// icmpConn 封装一个ICMP套接字
+type icmpConn struct {
+	fd int
+	// ipv4 是否为IPv4套接字
+	ipv4 bool
+	// privileged 是否为原始套接字，IPv4原始套接字需要手动写入IP首部
+	privileged bool
+	// id 数据报套接字由内核分配的ICMP ID，等于绑定后的本地端口
+	id int
+	// proto 原始套接字的协议，为0时是ICMP套接字
+	proto int
+	// txTimestamps 是否开启了发送时间戳
+	txTimestamps bool
+	// sends 成功的sendmsg次数，开启发送时间戳后每次占用一个编号（SOF_TIMESTAMPING_OPT_ID）
+	sends uint32
+	// rxStamp 最近一次接收到的内核时间戳，rxStamped为false时没有，只由接收协程访问
+	rxStamp   kernelStamp
+	rxStamped bool
+	// slots 轮流使用的接收缓冲区，next为下一个包使用的缓冲区，只由接收协程访问
+	slots []recvSlot
+	next  int
+}
+
+const (
+	// recvBufferLen 接收缓冲区的大小，能够容纳最大的IP数据报
+	recvBufferLen = 1 << 16
+	// recvOOBLen 控制消息缓冲区的大小，能够容纳时间戳、IP选项和扩展错误信息
+	recvOOBLen = 512
+	// recvQueueLen 接收协程与消费者之间通道的长度
+	recvQueueLen = 5
+	// recvSlots 接收缓冲区的个数。消费者正在处理一个包时，接收协程最多再有recvQueueLen个包
+	// 在通道中、一个包等待放入通道，因此交给消费者的包在它取出下一个包之前不会被覆盖
+	recvSlots = recvQueueLen + 2
+)
+
+// recvSlot 一个数据包的接收缓冲区和解析结果。解析直接引用缓冲区，echo报文也解析到这里，
+// 接收时不需要为每个包分配内存
+type recvSlot struct {
+	buf  []byte
+	oob  []byte
+	recv recvPacket
+	v4   ICMPv4Data
+	v4h  ipv4.Header
+	v6   ICMPv6Data
+	v6h  ipv6.Header
+	msg  icmp.Message
+	echo icmp.Echo
+}
+
+// listen 选择源地址后按照当前模式和目的地址的协议族建立套接字
+func (p *Pinger) listen() (*icmpConn, error) {
+	err := p.resolveSource()
+	if err != nil {
+		return nil, err
+	}
+	var conn *icmpConn
+	switch {
+	case p.ProbeType == ProbeTCP && p.Privileged():
+		conn, err = listenTCP(p.ipv4, p.SourceIpAddr)
+	case p.ProbeType == ProbeTCP:
+		// 非特权模式通过connect探测，不需要套接字
+		return nil, nil
+	case p.ProbeType == ProbeUDP:
+		conn, err = listenUDP(p.ipv4, p.SourceIpAddr, p.TTL)
+	default:
+		conn, err = listenICMP(p.ipv4, p.Privileged(), p.SourceIpAddr, p.TTL)
+	}
+	if err != nil {
+		return nil, err
+	}
+	err = p.bindSocket(conn.fd)
+	if err != nil {
+		conn.close()
+		return nil, err
+	}
+	if p.ProbeType == ProbeICMP {
+		err = p.setupBroadcast(conn)
+		if err != nil {
+			conn.close()
+			return nil, err
+		}
+	}
+	if conn.ipv4 && conn.privileged && p.ProbeType == ProbeICMP {
+		// 内核不会对手动填写首部的数据报分片，超过出接口MTU时需要自己分片，查询失败时不分片
+		p.mtu, _ = routeMTU(p.routeTarget(), p.Mark)
+	}
+	if p.KernelTimestamps {
+		err = conn.enableTimestamps()
+		if err != nil {
+			conn.close()
+			return nil, err
+		}
+	}
+	if !conn.privileged && p.ipOptions != nil {
+		// 数据报套接字不能写入IP首部，选项设置在套接字上
+		err = unix.SetsockoptString(conn.fd, unix.IPPROTO_IP, unix.IP_OPTIONS, string(p.ipOptions))
+		if err != nil {
+			fmt.Println(fmt.Sprintf("Set socket IP_OPTIONS error:%s", err.Error()))
+			conn.close()
+			return nil, err
+		}
+	}
+	if !conn.privileged {
+		// 数据报套接字的应答按照内核分配的ID匹配
+		p.id = conn.id
+	}
+	return conn, nil
+}
+
+// listenICMP 建立ICMP套接字并绑定到source，source为nil时绑定到通配地址。
+// hopLimit只对IPv6生效，IPv4的TTL写在手动填写的IP首部中
+func listenICMP(ipv4, privileged bool, source *net.IPAddr, hopLimit int) (*icmpConn, error) {
+	sockType := unix.SOCK_RAW
+	if !privileged {
+		sockType = unix.SOCK_DGRAM
+	}
+	domain, proto := unix.AF_INET, protocolICMP
+	if !ipv4 {
+		domain, proto = unix.AF_INET6, protocolIPv6ICMP
+	}
+	sock, err := unix.Socket(domain, sockType|unix.SOCK_NONBLOCK|unix.SOCK_CLOEXEC, proto)
+	if err != nil {
+		fmt.Println(fmt.Sprintf("Create socket error:%s", err.Error()))
+		return nil, err
+	}
+	conn := &icmpConn{fd: sock, ipv4: ipv4, privileged: privileged}
+	err = conn.setup(source, hopLimit)
+	if err != nil {
+		unix.Close(sock)
+		return nil, err
+	}
+	return conn, nil
+}
+
+func (c *icmpConn) setup(source *net.IPAddr, hopLimit int) error {
+	var err error
+	if c.ipv4 {
+		err = c.setupIPv4()
+	} else {
+		err = c.setupIPv6(hopLimit)
+	}
+	if err != nil {
+		return err
+	}
+	// 没有指定源地址时绑定到通配地址，数据报套接字在绑定时由内核分配ID
+	if source == nil {
+		source = &net.IPAddr{IP: net.IPv4zero}
+		if !c.ipv4 {
+			source.IP = net.IPv6unspecified
+		}
+	}
+	// 绑定本地源IP地址
+	err = unix.Bind(c.fd, sockaddr(source))
+	if err != nil {
+		fmt.Println(fmt.Sprintf("Bind SourceAddr:%s error:%s", source.String(), err.Error()))
+		return err
+	}
+	if !c.privileged {
+		local, err := unix.Getsockname(c.fd)
+		if err != nil {
+			return err
+		}
+		switch local := local.(type) {
+		case *unix.SockaddrInet4:
+			c.id = local.Port
+		case *unix.SockaddrInet6:
+			c.id = local.Port
+		}
+	}
+	return nil
+}
+
+func (c *icmpConn) setupIPv4() error {
+	var err error
+	if c.privileged {
+		// 设置为手动写入ip首部
+		err = unix.SetsockoptInt(c.fd, unix.IPPROTO_IP, unix.IP_HDRINCL, 1)
+		if err != nil {
+			fmt.Println(fmt.Sprintf("Set socket IP_HDRINCL error:%s", err.Error()))
+			return err
+		}
+	} else {
+		// 数据报套接字收不到IP首部，通过控制消息获取TTL
+		err = unix.SetsockoptInt(c.fd, unix.IPPROTO_IP, unix.IP_RECVTTL, 1)
+		if err != nil {
+			fmt.Println(fmt.Sprintf("Set socket IP_RECVTTL error:%s", err.Error()))
+			return err
+		}
+		err = unix.SetsockoptInt(c.fd, unix.IPPROTO_IP, unix.IP_RECVTOS, 1)
+		if err != nil {
+			fmt.Println(fmt.Sprintf("Set socket IP_RECVTOS error:%s", err.Error()))
+			return err
+		}
+		// 应答中的IP选项同样通过控制消息获取
+		err = unix.SetsockoptInt(c.fd, unix.IPPROTO_IP, unix.IP_RECVOPTS, 1)
+		if err != nil {
+			fmt.Println(fmt.Sprintf("Set socket IP_RECVOPTS error:%s", err.Error()))
+			return err
+		}
+		// 数据报套接字收不到差错报文，内核将其放入错误队列
+		err = unix.SetsockoptInt(c.fd, unix.IPPROTO_IP, unix.IP_RECVERR, 1)
+		if err != nil {
+			fmt.Println(fmt.Sprintf("Set socket IP_RECVERR error:%s", err.Error()))
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *icmpConn) setupIPv6(hopLimit int) error {
+	// IPv6不能手动写入首部，跳数限制通过套接字选项设置
+	err := unix.SetsockoptInt(c.fd, unix.IPPROTO_IPV6, unix.IPV6_UNICAST_HOPS, hopLimit)
+	if err != nil {
+		fmt.Println(fmt.Sprintf("Set socket IPV6_UNICAST_HOPS error:%s", err.Error()))
+		return err
+	}
+	// 收不到IPv6首部，通过控制消息获取跳数限制
+	err = unix.SetsockoptInt(c.fd, unix.IPPROTO_IPV6, unix.IPV6_RECVHOPLIMIT, 1)
+	if err != nil {
+		fmt.Println(fmt.Sprintf("Set socket IPV6_RECVHOPLIMIT error:%s", err.Error()))
+		return err
+	}
+	err = unix.SetsockoptInt(c.fd, unix.IPPROTO_IPV6, unix.IPV6_RECVTCLASS, 1)
+	if err != nil {
+		fmt.Println(fmt.Sprintf("Set socket IPV6_RECVTCLASS error:%s", err.Error()))
+		return err
+	}
+	if !c.privileged {
+		err = unix.SetsockoptInt(c.fd, unix.IPPROTO_IPV6, unix.IPV6_RECVERR, 1)
+		if err != nil {
+			fmt.Println(fmt.Sprintf("Set socket IPV6_RECVERR error:%s", err.Error()))
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *icmpConn) close() error {
+	return unix.Close(c.fd)
+}
+
+// sendTo 将b发送到dst
+func (c *icmpConn) sendTo(b []byte, dst *net.IPAddr) error {
+	return c.sendMsg(b, nil, sockaddr(dst))
+}
+
+// sendMarked 将b发送到dst，并通过控制消息为这一个包设置TTL（IPv6为跳数限制）和
+// TOS（IPv6为流量类别）。用于不能手动填写IP首部的套接字，多个Pinger共用套接字时互不影响
+func (c *icmpConn) sendMarked(b []byte, dst unix.Sockaddr, ttl, tos int) error {
+	var oob []byte
+	if c.ipv4 {
+		oob = append(cmsgInt(unix.IPPROTO_IP, unix.IP_TTL, ttl), cmsgInt(unix.IPPROTO_IP, unix.IP_TOS, tos)...)
+	} else {
+		oob = append(cmsgInt(unix.IPPROTO_IPV6, unix.IPV6_HOPLIMIT, ttl), cmsgInt(unix.IPPROTO_IPV6, unix.IPV6_TCLASS, tos)...)
+	}
+	return c.sendMsg(b, oob, dst)
+}
+
+func (c *icmpConn) sendMsg(b, oob []byte, dst unix.Sockaddr) error {
+	err := unix.Sendmsg(c.fd, b, oob, dst, 0)
+	if isICMPErrno(err) {
+		// 数据报套接字上之前收到的差错会让这次发送失败并被清除，重试一次，
+		// 真正因为本次发送产生的错误会再次返回
+		err = unix.Sendmsg(c.fd, b, oob, dst, 0)
+	}
+	if err == nil {
+		c.sends++
+	}
+	return err
+}
+
+// recv 接收并解析一个数据包
+func (c *icmpConn) recv() (icmpPacket, error) {
+	switch c.proto {
+	case unix.IPPROTO_TCP:
+		return c.recvTCP()
+	case unix.IPPROTO_UDP:
+		return c.recvUDP()
+	}
+	if !c.ipv4 {
+		return c.recvIPv6()
+	}
+	if !c.privileged {
+		return c.recvDatagram()
+	}
+	slot := c.slot()
+	bytes, oob, _, err := c.recvmsg(0)
+	if err != nil {
+		return nil, err
+	}
+	c.stampRecv(oob)
+	data := &slot.v4
+	*data = ICMPv4Data{IPv4Header: &slot.v4h}
+	// 解析IP首部和icmp报文
+	err = data.unmarshal(bytes, &slot.msg, &slot.echo)
+	if err != nil {
+		return nil, &parseError{err: err}
+	}
+	return data, nil
+}
+
+// slot 下一个包使用的接收缓冲区，第一次接收时分配
+func (c *icmpConn) slot() *recvSlot {
+	if c.slots == nil {
+		c.slots = make([]recvSlot, recvSlots)
+		for i := range c.slots {
+			c.slots[i].buf = make([]byte, recvBufferLen)
+			c.slots[i].oob = make([]byte, recvOOBLen)
+		}
+	}
+	return &c.slots[c.next]
+}
+
+// nextSlot 当前的包已经交给消费者，之后的包使用下一个缓冲区。
+// 无法解析而丢弃的包不调用它，缓冲区留给下一个包
+func (c *icmpConn) nextSlot() {
+	c.next = (c.next + 1) % len(c.slots)
+}
+
+// recvmsg 使用当前的接收缓冲区接收一个数据报，返回的数据和控制消息都引用该缓冲区，
+// 在消费者取出下一个包之前有效
+func (c *icmpConn) recvmsg(flags int) ([]byte, []byte, unix.Sockaddr, error) {
+	slot := c.slot()
+	n, oobn, _, from, err := unix.Recvmsg(c.fd, slot.buf, slot.oob, flags)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	return slot.buf[:n], slot.oob[:oobn], from, nil
+}
+
+// recvDatagram 从数据报套接字接收，内核只返回ICMP报文，IP首部根据对端地址和控制消息补全
+func (c *icmpConn) recvDatagram() (*ICMPv4Data, error) {
+	slot := c.slot()
+	bytes, oob, from, err := c.recvmsg(0)
+	if err != nil {
+		return nil, err
+	}
+	c.stampRecv(oob)
+	options := parseCmsgBytes(oob, unix.IPPROTO_IP, unix.IP_RECVOPTS)
+	header := &slot.v4h
+	*header = ipv4.Header{
+		Version:  ipv4.Version,
+		Len:      ipv4.HeaderLen + len(options),
+		TotalLen: ipv4.HeaderLen + len(options) + len(bytes),
+		Protocol: protocolICMP,
+		Options:  options,
+	}
+	if sa, ok := from.(*unix.SockaddrInet4); ok {
+		header.Src = net.IP(sa.Addr[:])
+	}
+	header.TTL = parseTTL(oob)
+	if tos := parseCmsgBytes(oob, unix.IPPROTO_IP, unix.IP_TOS); tos != nil {
+		header.TOS = int(tos[0])
+	}
+
+	icmpData, err := parseMessage(protocolICMP, bytes, &slot.msg, &slot.echo)
+	if err != nil {
+		return nil, &parseError{err: err}
+	}
+	slot.v4 = ICMPv4Data{IPv4Header: header, ICMPData: icmpData, raw: bytes}
+	return &slot.v4, nil
+}
+
+// recvIPv6 从IPv6套接字接收，内核不返回IPv6首部，跳数限制从控制消息中获取
+func (c *icmpConn) recvIPv6() (*ICMPv6Data, error) {
+	slot := c.slot()
+	bytes, oob, from, err := c.recvmsg(0)
+	if err != nil {
+		return nil, err
+	}
+	c.stampRecv(oob)
+	slot.v6h = ipv6.Header{
+		Version:      ipv6.Version,
+		TrafficClass: parseCmsgInt(oob, unix.IPPROTO_IPV6, unix.IPV6_TCLASS),
+		NextHeader:   protocolIPv6ICMP,
+		HopLimit:     parseHopLimit(oob),
+	}
+	if sa, ok := from.(*unix.SockaddrInet6); ok {
+		slot.v6h.Src = net.IP(sa.Addr[:])
+	}
+	data := &slot.v6
+	*data = ICMPv6Data{IPv6Header: &slot.v6h}
+	err = data.unmarshal(bytes, &slot.msg, &slot.echo)
+	if err != nil {
+		return nil, &parseError{err: err}
+	}
+	return data, nil
+}
+
+// recvErrQueue 从错误队列中取出数据报套接字收到的差错。内核只返回发出的ICMP报文、
+// 原始目的地址和扩展错误信息，这里将其补全为与原始套接字收到的相同的差错报文
+func (c *icmpConn) recvErrQueue() (icmpPacket, error) {
+	bytes, oob, from, err := c.recvmsg(unix.MSG_ERRQUEUE)
+	if err != nil {
+		return nil, err
+	}
+	c.stampRecv(oob)
+	ee, offender := parseExtendedErr(oob)
+	if ee != nil && ee.Origin == unix.SO_EE_ORIGIN_TIMESTAMPING {
+		// 发送时间戳，只关心数据包交给网卡时的时间
+		if ee.Info != unix.SCM_TSTAMP_SND || !c.rxStamped {
+			return nil, &parseError{err: errors.New("not a send timestamp")}
+		}
+		return &txTimestamp{key: ee.Data, kernelStamp: c.rxStamp}, nil
+	}
+	if ee == nil || (ee.Origin != unix.SO_EE_ORIGIN_ICMP && ee.Origin != unix.SO_EE_ORIGIN_ICMP6) {
+		return nil, &parseError{err: errors.New("not an ICMP error")}
+	}
+
+	// 差错报文首部：类型、代码、校验和以及4字节的附加信息
+	msg := make([]byte, icmpEchoHeaderLen, icmpEchoHeaderLen+ipv6.HeaderLen+udpHeaderLen+len(bytes))
+	msg[0], msg[1] = ee.Type, ee.Code
+	var dst net.IP
+	var quoted []byte
+	// UDP套接字只返回原始数据报的负载，按照本地端口和原始目的端口补全UDP首部
+	payload, proto := bytes, protocolICMP
+	if !c.ipv4 {
+		proto = protocolIPv6ICMP
+	}
+	if c.proto == unix.IPPROTO_UDP {
+		payload, proto = udpHeader(c.id, sockaddrPort(from), bytes), unix.IPPROTO_UDP
+	}
+	if c.ipv4 {
+		switch ipv4.ICMPType(ee.Type) {
+		case ipv4.ICMPTypeDestinationUnreachable:
+			binary.BigEndian.PutUint16(msg[6:8], uint16(ee.Info))
+		case ipv4.ICMPTypeParameterProblem:
+			msg[4] = byte(ee.Info)
+		}
+		if sa, ok := from.(*unix.SockaddrInet4); ok {
+			dst = net.IP(sa.Addr[:])
+		}
+		quoted = make([]byte, ipv4.HeaderLen)
+		err = putIPv4Header(quoted, &ipv4.Header{Dst: dst}, ipv4.HeaderLen+len(payload), proto)
+		if err != nil {
+			return nil, &parseError{err: err}
+		}
+	} else {
+		switch ipv6.ICMPType(ee.Type) {
+		case ipv6.ICMPTypePacketTooBig, ipv6.ICMPTypeParameterProblem:
+			binary.BigEndian.PutUint32(msg[4:8], ee.Info)
+		}
+		if sa, ok := from.(*unix.SockaddrInet6); ok {
+			dst = net.IP(sa.Addr[:])
+		}
+		quoted = quotedIPv6Header(dst, len(payload), proto)
+	}
+	msg = append(append(msg, quoted...), payload...)
+
+	if c.ipv4 {
+		icmpData, err := icmp.ParseMessage(protocolICMP, msg)
+		if err != nil {
+			return nil, &parseError{err: err}
+		}
+		header := &ipv4.Header{
+			Version:  ipv4.Version,
+			Len:      ipv4.HeaderLen,
+			TotalLen: ipv4.HeaderLen + len(msg),
+			Protocol: protocolICMP,
+			Src:      offender,
+		}
+		return &ICMPv4Data{IPv4Header: header, ICMPData: icmpData, raw: msg}, nil
+	}
+	data := &ICMPv6Data{
+		IPv6Header: &ipv6.Header{
+			Version:    ipv6.Version,
+			NextHeader: protocolIPv6ICMP,
+			Src:        offender,
+		},
+	}
+	err = data.Unmarshal(msg)
+	if err != nil {
+		return nil, &parseError{err: err}
+	}
+	return data, nil
+}
+
+// sockExtendedErrLen struct sock_extended_err的长度
+const sockExtendedErrLen = 16
+
+// parseExtendedErr 从控制消息中解析扩展错误信息和发出差错报文的地址
+func parseExtendedErr(oob []byte) (*unix.SockExtendedErr, net.IP) {
+	msgs, err := unix.ParseSocketControlMessage(oob)
+	if err != nil {
+		return nil, nil
+	}
+	for _, msg := range msgs {
+		isV4 := msg.Header.Level == unix.IPPROTO_IP && msg.Header.Type == unix.IP_RECVERR
+		isV6 := msg.Header.Level == unix.IPPROTO_IPV6 && msg.Header.Type == unix.IPV6_RECVERR
+		if !isV4 && !isV6 || len(msg.Data) < sockExtendedErrLen {
+			continue
+		}
+		ee := &unix.SockExtendedErr{
+			Errno:  binary.NativeEndian.Uint32(msg.Data[0:4]),
+			Origin: msg.Data[4],
+			Type:   msg.Data[5],
+			Code:   msg.Data[6],
+			Pad:    msg.Data[7],
+			Info:   binary.NativeEndian.Uint32(msg.Data[8:12]),
+			Data:   binary.NativeEndian.Uint32(msg.Data[12:16]),
+		}
+		// 扩展错误信息之后是发出差错报文的地址（SO_EE_OFFENDER）
+		offender := msg.Data[sockExtendedErrLen:]
+		switch {
+		case isV4 && len(offender) >= unix.SizeofSockaddrInet4:
+			return ee, net.IP(append([]byte(nil), offender[4:8]...))
+		case isV6 && len(offender) >= unix.SizeofSockaddrInet6:
+			return ee, net.IP(append([]byte(nil), offender[8:24]...))
+		}
+		return ee, nil
+	}
+	return nil, nil
+}
+
+// isICMPErrno 数据报套接字收到差错报文后，下一次接收会返回对应的错误码，
+// 差错本身已经从错误队列中取出，这类错误不需要结束接收
+func isICMPErrno(err error) bool {
+	return errors.Is(err, unix.EHOSTUNREACH) || errors.Is(err, unix.ENETUNREACH) ||
+		errors.Is(err, unix.ECONNREFUSED) || errors.Is(err, unix.EPROTO) ||
+		errors.Is(err, unix.EMSGSIZE) || errors.Is(err, unix.EACCES) ||
+		errors.Is(err, unix.EHOSTDOWN) || errors.Is(err, unix.ENONET)
+}
+
+// parseError 收到的数据包无法解析
+type parseError struct {
+	err error
+}
+
+func (e *parseError) Error() string {
+	return "parse packet error: " + e.err.Error()
+}
+
+func (e *parseError) Unwrap() error {
+	return e.err
+}
+
+// receiver 每个套接字一个协程，在后台接收数据包
+type receiver struct {
+	// recv 收到的数据包
+	recv chan *recvPacket
+	// errs 不可恢复的接收错误
+	errs chan error
+	// wake 用于唤醒阻塞在poll上的接收协程
+	wake int
+	quit chan struct{}
+	wg   sync.WaitGroup
+}
+
+func newReceiver() (*receiver, error) {
+	wake, err := unix.Eventfd(0, unix.EFD_CLOEXEC|unix.EFD_NONBLOCK)
+	if err != nil {
+		fmt.Println(fmt.Sprintf("Create eventfd error:%s", err.Error()))
+		return nil, err
+	}
+	return &receiver{
+		recv: make(chan *recvPacket, recvQueueLen),
+		errs: make(chan error, 1),
+		wake: wake,
+		quit: make(chan struct{}),
+	}, nil
+}
+
+// start 启动一个协程从conn接收数据包
+func (r *receiver) start(conn *icmpConn) {
+	r.wg.Add(1)
+	go func() {
+		defer r.wg.Done()
+		r.loop(conn)
+	}()
+}
+
+// stop 唤醒所有接收协程并等待其退出，之后才可以关闭套接字
+func (r *receiver) stop() {
+	close(r.quit)
+	wakeup(r.wake)
+	r.wg.Wait()
+	unix.Close(r.wake)
+}
+
+// loop 持续接收数据包，直到wake可读、quit被关闭或者发生不可恢复的错误
+func (r *receiver) loop(conn *icmpConn) {
+	fds := []unix.PollFd{
+		{Fd: int32(conn.fd), Events: unix.POLLIN},
+		{Fd: int32(r.wake), Events: unix.POLLIN},
+	}
+	for {
+		_, err := unix.Poll(fds, -1)
+		if err != nil {
+			if errors.Is(err, unix.EINTR) {
+				continue
+			}
+			r.fail(err)
+			return
+		}
+		if fds[1].Revents != 0 {
+			return
+		}
+		var data icmpPacket
+		if fds[0].Revents&unix.POLLERR != 0 {
+			data, err = conn.recvErrQueue()
+			if errors.Is(err, unix.EAGAIN) {
+				// 错误队列为空时是套接字上的待处理错误，由recv取出
+				data, err = conn.recv()
+			}
+		} else {
+			data, err = conn.recv()
+		}
+		receivedAt, source := time.Now(), TimestampUser
+		var hwStamp time.Time
+		if conn.rxStamped {
+			if !conn.rxStamp.at.IsZero() {
+				receivedAt, source = conn.rxStamp.at, TimestampSoftware
+			}
+			hwStamp = conn.rxStamp.hw
+		}
+		if err != nil {
+			if errors.Is(err, unix.EAGAIN) || errors.Is(err, unix.EINTR) || isICMPErrno(err) {
+				continue
+			}
+			var parseErr *parseError
+			if errors.As(err, &parseErr) {
+				// 无法解析的包直接丢弃
+				continue
+			}
+			r.fail(err)
+			return
+		}
+		slot := conn.slot()
+		slot.recv = recvPacket{data: data, receivedAt: receivedAt, source: source, hwStamp: hwStamp}
+		select {
+		case r.recv <- &slot.recv:
+			conn.nextSlot()
+		case <-r.quit:
+			return
+		}
+	}
+}
+
+// fail 上报错误，已有错误未被处理时丢弃
+func (r *receiver) fail(err error) {
+	select {
+	case r.errs <- err:
+	default:
+	}
+}
+
+// wakeup 向eventfd写入数据，唤醒等待它的poll
+func wakeup(fd int) {
+	var buf [8]byte
+	binary.NativeEndian.PutUint64(buf[:], 1)
+	unix.Write(fd, buf[:])
+}
+
+// sockaddr 将IP地址转换为对应协议族的套接字地址
+func sockaddr(addr *net.IPAddr) unix.Sockaddr {
+	if isIPv4(addr.IP) {
+		sa := &unix.SockaddrInet4{}
+		copy(sa.Addr[:], addr.IP.To4())
+		return sa
+	}
+	sa := &unix.SockaddrInet6{}
+	copy(sa.Addr[:], addr.IP.To16())
+	// 链路本地地址需要指定网口
+	if len(addr.Zone) != 0 {
+		if ifi, err := net.InterfaceByName(addr.Zone); err == nil {
+			sa.ZoneId = uint32(ifi.Index)
+		}
+	}
+	return sa
+}
+
+// parseTTL 从控制消息中解析IP_TTL，解析失败返回0
+func parseTTL(oob []byte) int {
+	return parseCmsgInt(oob, unix.IPPROTO_IP, unix.IP_TTL)
+}
+
+// parseHopLimit 从控制消息中解析IPV6_HOPLIMIT，解析失败返回0
+func parseHopLimit(oob []byte) int {
+	return parseCmsgInt(oob, unix.IPPROTO_IPV6, unix.IPV6_HOPLIMIT)
+}
+
+func parseCmsgInt(oob []byte, level, typ int32) int {
+	data := parseCmsgBytes(oob, level, typ)
+	if len(data) < 4 {
+		return 0
+	}
+	return int(binary.NativeEndian.Uint32(data))
+}
+
+// cmsgInt 生成一个携带int的控制消息
+func cmsgInt(level, typ, v int) []byte {
+	b := make([]byte, unix.CmsgSpace(4))
+	h := (*unix.Cmsghdr)(unsafe.Pointer(&b[0]))
+	h.Level = int32(level)
+	h.Type = int32(typ)
+	h.SetLen(unix.CmsgLen(4))
+	binary.NativeEndian.PutUint32(b[unix.CmsgLen(0):], uint32(v))
+	return b
+}
+
+// parseCmsgBytes 返回控制消息中指定类型的数据，没有时返回nil
+func parseCmsgBytes(oob []byte, level, typ int32) []byte {
+	msgs, err := unix.ParseSocketControlMessage(oob)
+	if err != nil {
+		return nil
+	}
+	for _, msg := range msgs {
+		if msg.Header.Level == level && msg.Header.Type == typ && len(msg.Data) > 0 {
+			return msg.Data
+		}
+	}
+	return nil
+}
@@ -0,0 +1,247 @@
+package shlping
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/Senhnn/go_tool/shlnl"
+	"golang.org/x/sys/unix"
+	"net"
+	"syscall"
+)
+
+// resolveSource 选择源地址，指定了SourceAddr时直接使用
+func (p *Pinger) resolveSource() error {
+	source, err := selectSource(p.network, p.SourceAddr, p.routeTarget(), p.Mark)
+	if err != nil {
+		return err
+	}
+	// 只有链路本地地址需要网口
+	if !source.IP.IsLinkLocalUnicast() {
+		source.Zone = p.TargetIpaddr.Zone
+	}
+	p.SourceIpAddr = source
+	return nil
+}
+
+// routeTarget 查询路由时使用的目的地址，Zone为出接口
+func (p *Pinger) routeTarget() *net.IPAddr {
+	target := p.TargetIpaddr
+	switch {
+	case p.MulticastInterface != "" && target.IP.IsMulticast():
+		// 组播按照指定的网口查询路由
+		target = &net.IPAddr{IP: target.IP, Zone: p.MulticastInterface}
+	case p.bindDevice() != "" && target.Zone == "":
+		// 绑定网口或者VRF后按照该设备查询路由，VRF使用其路由表
+		target = &net.IPAddr{IP: target.IP, Zone: p.bindDevice()}
+	}
+	return target
+}
+
+// selectSource 选择发往target时使用的源地址。sourceAddr不为空时解析并直接使用，
+// 否则通过内核路由查询得到源地址，查询失败时退回到连接UDP套接字的方式。
+// target.Zone为查询时的出接口，mark不为0时按照该fwmark匹配策略路由
+func selectSource(network, sourceAddr string, target *net.IPAddr, mark int) (*net.IPAddr, error) {
+	if len(sourceAddr) != 0 {
+		ipaddr, err := net.ResolveIPAddr(network, sourceAddr)
+		if err != nil {
+			return nil, fmt.Errorf("resolve source address %s: %w", sourceAddr, err)
+		}
+		if isIPv4(ipaddr.IP) != isIPv4(target.IP) {
+			return nil, fmt.Errorf("source address %s and target address %s are of different families", ipaddr, target)
+		}
+		return ipaddr, nil
+	}
+
+	ip, routeErr := routeSource(target, mark)
+	if routeErr == nil {
+		return &net.IPAddr{IP: ip, Zone: target.Zone}, nil
+	}
+	ip, dialErr := dialSource(target, mark)
+	if dialErr != nil {
+		return nil, fmt.Errorf("select source address for %s: route lookup: %v, udp connect: %w", target, routeErr, dialErr)
+	}
+	return &net.IPAddr{IP: ip, Zone: target.Zone}, nil
+}
+
+// errNoPrefSrc 路由中没有首选源地址
+var errNoPrefSrc = errors.New("route has no preferred source address")
+
+// routeSource 通过netlink查询发往dst的路由，返回其首选源地址，相当于ip route get
+func routeSource(dst *net.IPAddr, mark int) (net.IP, error) {
+	attrs, err := queryRoute(dst, mark)
+	if err != nil {
+		return nil, err
+	}
+	for _, attr := range attrs {
+		if attr.Attr.Type == unix.RTA_PREFSRC {
+			return net.IP(attr.Value), nil
+		}
+	}
+	return nil, errNoPrefSrc
+}
+
+// routeMTU 查询发往dst的路由的出接口MTU，路由上设置了更小的MTU（包括缓存的路径MTU）时使用路由的MTU
+func routeMTU(dst *net.IPAddr, mark int) (int, error) {
+	attrs, err := queryRoute(dst, mark)
+	if err != nil {
+		return 0, err
+	}
+	var mtu int
+	for _, attr := range attrs {
+		switch attr.Attr.Type {
+		case unix.RTA_OIF:
+			if len(attr.Value) < 4 {
+				continue
+			}
+			ifi, err := net.InterfaceByIndex(int(binary.NativeEndian.Uint32(attr.Value)))
+			if err != nil {
+				return 0, err
+			}
+			if mtu == 0 || ifi.MTU < mtu {
+				mtu = ifi.MTU
+			}
+		case unix.RTA_METRICS:
+			if metric := routeMetricMTU(attr.Value); metric > 0 && (mtu == 0 || metric < mtu) {
+				mtu = metric
+			}
+		}
+	}
+	if mtu == 0 {
+		return 0, errors.New("route has no output interface")
+	}
+	return mtu, nil
+}
+
+// routeMetricMTU 从RTA_METRICS的嵌套属性中取出RTAX_MTU，没有时返回0
+func routeMetricMTU(b []byte) int {
+	for len(b) >= unix.SizeofRtAttr {
+		l := int(binary.NativeEndian.Uint16(b[0:2]))
+		if l < unix.SizeofRtAttr || l > len(b) {
+			return 0
+		}
+		if binary.NativeEndian.Uint16(b[2:4]) == unix.RTAX_MTU && l >= unix.SizeofRtAttr+4 {
+			return int(binary.NativeEndian.Uint32(b[unix.SizeofRtAttr:]))
+		}
+		b = b[min(shlnl.RtaAlignOf(l), len(b)):]
+	}
+	return 0
+}
+
+// queryRoute 通过netlink查询发往dst的路由，返回路由的属性
+func queryRoute(dst *net.IPAddr, mark int) ([]syscall.NetlinkRouteAttr, error) {
+	sock, err := shlnl.NlSocket(unix.NETLINK_ROUTE)
+	if err != nil {
+		return nil, err
+	}
+	defer unix.Close(sock)
+
+	family, dstIP := unix.AF_INET, dst.IP.To4()
+	if dstIP == nil {
+		family, dstIP = unix.AF_INET6, dst.IP.To16()
+	}
+
+	data := make([]byte, 0, 128)
+	nlMsgHdr := &unix.NlMsghdr{
+		Len:   unix.NLMSG_HDRLEN + unix.SizeofRtMsg,
+		Type:  unix.RTM_GETROUTE,
+		Flags: unix.NLM_F_REQUEST,
+		Seq:   1,
+	}
+	rtMsg := &unix.RtMsg{
+		Family:  uint8(family),
+		Dst_len: uint8(len(dstIP) * 8),
+	}
+	data = append(data, make([]byte, unix.NLMSG_HDRLEN)...)
+	data = append(data, shlnl.WriteRtMsgToBuf(rtMsg)...)
+
+	// RTA_DST 目的地址
+	rta := &unix.RtAttr{
+		Len:  unix.SizeofRtAttr + uint16(len(dstIP)),
+		Type: unix.RTA_DST,
+	}
+	data = append(data, shlnl.WriteRtAttrToBuf(rta, dstIP)...)
+	data = append(data, make([]byte, shlnl.RtaAlignOf(int(rta.Len))-int(rta.Len))...)
+
+	// 链路本地地址和绑定了网口时需要指定出接口
+	if len(dst.Zone) != 0 {
+		ifi, err := net.InterfaceByName(dst.Zone)
+		if err != nil {
+			return nil, err
+		}
+		oif := make([]byte, 4)
+		binary.NativeEndian.PutUint32(oif, uint32(ifi.Index))
+		rta = &unix.RtAttr{
+			Len:  unix.SizeofRtAttr + uint16(len(oif)),
+			Type: unix.RTA_OIF,
+		}
+		data = append(data, shlnl.WriteRtAttrToBuf(rta, oif)...)
+	}
+	// RTA_MARK 策略路由匹配的fwmark
+	if mark != 0 {
+		fwmark := make([]byte, 4)
+		binary.NativeEndian.PutUint32(fwmark, uint32(mark))
+		rta = &unix.RtAttr{
+			Len:  unix.SizeofRtAttr + uint16(len(fwmark)),
+			Type: unix.RTA_MARK,
+		}
+		data = append(data, shlnl.WriteRtAttrToBuf(rta, fwmark)...)
+	}
+	nlMsgHdr.Len = uint32(len(data))
+	copy(data, shlnl.WriteNlMsghdrToBuf(nlMsgHdr))
+
+	err = unix.Sendto(sock, data, 0, &unix.SockaddrNetlink{Family: unix.AF_NETLINK})
+	if err != nil {
+		return nil, err
+	}
+	buf := make([]byte, 4096)
+	n, _, err := unix.Recvfrom(sock, buf, 0)
+	if err != nil {
+		return nil, err
+	}
+	msgs, err := syscall.ParseNetlinkMessage(buf[:n])
+	if err != nil {
+		return nil, err
+	}
+	for i := range msgs {
+		switch msgs[i].Header.Type {
+		case unix.NLMSG_ERROR:
+			if len(msgs[i].Data) >= 4 {
+				if errno := int32(binary.NativeEndian.Uint32(msgs[i].Data)); errno != 0 {
+					return nil, unix.Errno(-errno)
+				}
+			}
+		case unix.RTM_NEWROUTE:
+			return syscall.ParseNetlinkRouteAttr(&msgs[i])
+		}
+	}
+	return nil, errors.New("no route in netlink reply")
+}
+
+// dialSource 连接一个UDP套接字，由内核选择源地址，不会发出任何数据。
+// 与routeSource相同，dst.Zone为出接口，mark为fwmark
+func dialSource(dst *net.IPAddr, mark int) (net.IP, error) {
+	dialer := &net.Dialer{
+		Control: func(network, address string, c syscall.RawConn) error {
+			var err error
+			ctrlErr := c.Control(func(fd uintptr) {
+				if len(dst.Zone) != 0 {
+					err = unix.BindToDevice(int(fd), dst.Zone)
+				}
+				if err == nil && mark != 0 {
+					err = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_MARK, mark)
+				}
+			})
+			if ctrlErr != nil {
+				return ctrlErr
+			}
+			return err
+		},
+	}
+	conn, err := dialer.Dial("udp", net.JoinHostPort(dst.String(), "9"))
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	return conn.LocalAddr().(*net.UDPAddr).IP, nil
+}
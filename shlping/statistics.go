@@ -0,0 +1,156 @@
+package shlping
+
+import (
+	"net"
+	"time"
+)
+
+// Statistics 一次ping的统计信息
+type Statistics struct {
+	// PacketsRecv 收到的包数
+	PacketsRecv int
+	// PacketsSent 已经发送的包数
+	PacketsSent int
+	// PacketsRecvDuplicates 收到重复的包数
+	PacketsRecvDuplicates int
+	// PacketsErrors 收到的差错报文数
+	PacketsErrors int
+	// PacketLoss 丢包率，百分比
+	PacketLoss float64
+	// IPAddr 目的地址
+	IPAddr *net.IPAddr
+	// Addr 目的地址
+	Addr string
+	// Rtts 所有包的RTT，Pinger.RecordRtts为false时为空
+	Rtts []time.Duration
+	// MinRtt 最小RTT
+	MinRtt time.Duration
+	// MaxRtt 最大RTT
+	MaxRtt time.Duration
+	// AvgRtt 平均RTT
+	AvgRtt time.Duration
+	// StdDevRtt RTT的标准差
+	StdDevRtt time.Duration
+	// P50Rtt RTT的中位数，分位数由直方图估计，误差约为3%
+	P50Rtt time.Duration
+	// P90Rtt RTT的90分位数
+	P90Rtt time.Duration
+	// P99Rtt RTT的99分位数
+	P99Rtt time.Duration
+	// P999Rtt RTT的99.9分位数
+	P999Rtt time.Duration
+	// Jitter 按照RFC 3550计算的RTT抖动
+	Jitter time.Duration
+	// Histogram RTT直方图的快照
+	Histogram *RTTHistogram
+	// DSCPStats 按照应答中的DSCP分类的统计信息，可以用来比较不同服务等级的延迟，
+	// 以及发现途中被重新标记的包
+	DSCPStats map[int]*DSCPStatistics
+	// Responders 广播和组播ping中每个应答者的统计信息，按照第一次应答的先后排列
+	Responders []*ResponderStatistics
+}
+
+// DSCPStatistics 一个DSCP的RTT统计信息
+type DSCPStatistics struct {
+	// PacketsRecv 收到的该DSCP的应答数
+	PacketsRecv int
+	// MinRtt 最小RTT
+	MinRtt time.Duration
+	// MaxRtt 最大RTT
+	MaxRtt time.Duration
+	// AvgRtt 平均RTT
+	AvgRtt time.Duration
+	// StdDevRtt RTT的标准差
+	StdDevRtt time.Duration
+}
+
+// ResponderStatistics 广播和组播ping中一个应答者的统计信息
+type ResponderStatistics struct {
+	// IPAddr 应答者的地址
+	IPAddr *net.IPAddr
+	// PacketsRecv 该应答者应答的请求数
+	PacketsRecv int
+	// PacketsRecvDuplicates 该应答者对同一个请求的重复应答数
+	PacketsRecvDuplicates int
+	// PacketLoss 该应答者没有应答的请求所占的百分比
+	PacketLoss float64
+	// MinRtt 最小RTT
+	MinRtt time.Duration
+	// MaxRtt 最大RTT
+	MaxRtt time.Duration
+	// AvgRtt 平均RTT
+	AvgRtt time.Duration
+	// StdDevRtt RTT的标准差
+	StdDevRtt time.Duration
+}
+
+// Statistics 返回当前的统计信息，Run执行过程中也可以调用
+func (p *Pinger) Statistics() *Statistics {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return p.statistics()
+}
+
+// statistics 调用方需持有p.lock
+func (p *Pinger) statistics() *Statistics {
+	s := &Statistics{
+		PacketsRecv:           p.PacketsRecv,
+		PacketsSent:           p.PacketsSent,
+		PacketsRecvDuplicates: p.PacketsRecvDuplicates,
+		PacketsErrors:         p.PacketsErrors,
+		IPAddr:                p.TargetIpaddr,
+		Addr:                  p.TargetAddr,
+	}
+	if p.RecordRtts {
+		s.Rtts = append([]time.Duration(nil), p.rtts...)
+	}
+	if s.PacketsSent > 0 {
+		s.PacketLoss = float64(s.PacketsSent-s.PacketsRecv) / float64(s.PacketsSent) * 100
+		if s.PacketLoss < 0 {
+			s.PacketLoss = 0
+		}
+	}
+	s.DSCPStats = make(map[int]*DSCPStatistics, len(p.dscpStats))
+	for dscp, stats := range p.dscpStats {
+		s.DSCPStats[dscp] = &DSCPStatistics{
+			PacketsRecv: stats.count,
+			MinRtt:      stats.min,
+			MaxRtt:      stats.max,
+			AvgRtt:      stats.avg(),
+			StdDevRtt:   stats.stdDev(),
+		}
+	}
+	for _, r := range p.responders {
+		rs := &ResponderStatistics{
+			IPAddr:                r.addr,
+			PacketsRecv:           r.stats.count,
+			PacketsRecvDuplicates: r.duplicates,
+			MinRtt:                r.stats.min,
+			MaxRtt:                r.stats.max,
+			AvgRtt:                r.stats.avg(),
+			StdDevRtt:             r.stats.stdDev(),
+		}
+		if s.PacketsSent > 0 {
+			rs.PacketLoss = max(float64(s.PacketsSent-rs.PacketsRecv)/float64(s.PacketsSent)*100, 0)
+		}
+		s.Responders = append(s.Responders, rs)
+	}
+	s.MinRtt = p.rttStats.min
+	s.MaxRtt = p.rttStats.max
+	s.AvgRtt = p.rttStats.avg()
+	s.StdDevRtt = p.rttStats.stdDev()
+	s.P50Rtt = p.histogram.Quantile(0.5)
+	s.P90Rtt = p.histogram.Quantile(0.9)
+	s.P99Rtt = p.histogram.Quantile(0.99)
+	s.P999Rtt = p.histogram.Quantile(0.999)
+	s.Jitter = time.Duration(p.jitter.value)
+	s.Histogram = p.histogram.clone()
+	return s
+}
+
+// finish Run结束时触发OnFinish
+func (p *Pinger) finish() {
+	if handler := p.OnFinish; handler != nil {
+		handler(p.Statistics())
+	}
+}
@@ -0,0 +1,365 @@
+package shlping
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/sys/unix"
+	"net"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+const (
+	// tcpHeaderLen 不带选项的TCP首部长度
+	tcpHeaderLen = 20
+	// tcpSynWindow SYN探测包的接收窗口
+	tcpSynWindow = 64240
+	// defaultTCPPort TCP探测默认的目的端口
+	defaultTCPPort = 80
+	// tcpConnectWait connect方式等待握手完成的时间，超过后内核会重传SYN，
+	// 之后测得的时间不再是一次往返
+	tcpConnectWait = time.Second
+
+	tcpFlagSYN = 0x02
+	tcpFlagRST = 0x04
+	tcpFlagACK = 0x10
+)
+
+// tcpSegment 收到的TCP应答，或者connect方式得到的握手结果。
+// 实现icmpPacket以便和ICMP应答走同一个接收流程，message()为nil
+type tcpSegment struct {
+	srcIP   net.IP
+	srcPort int
+	dstPort int
+	ack     uint32
+	flags   uint8
+	ttl     int
+	tos     int
+	length  int
+	// options IPv4首部中的选项
+	options []byte
+	// rtt connect方式直接测得的握手时间，原始套接字方式为0
+	rtt time.Duration
+}
+
+func (s *tcpSegment) src() net.IP { return s.srcIP }
+
+func (s *tcpSegment) hopLimit() int { return s.ttl }
+
+func (s *tcpSegment) trafficClass() int { return s.tos }
+
+func (s *tcpSegment) icmpLen() int { return s.length }
+
+func (s *tcpSegment) message() *icmp.Message { return nil }
+
+// parseTCP 解析TCP首部
+func parseTCP(b []byte) (*tcpSegment, error) {
+	if len(b) < tcpHeaderLen {
+		return nil, errors.New("tcp segment too short")
+	}
+	return &tcpSegment{
+		srcPort: int(binary.BigEndian.Uint16(b[0:2])),
+		dstPort: int(binary.BigEndian.Uint16(b[2:4])),
+		ack:     binary.BigEndian.Uint32(b[8:12]),
+		flags:   b[13],
+		length:  len(b),
+	}, nil
+}
+
+// listenTCP 建立接收TCP应答的原始套接字。IPv4手动填写IP首部，
+// IPv6由内核根据IPV6_CHECKSUM计算校验和
+func listenTCP(ipv4 bool, source *net.IPAddr) (*icmpConn, error) {
+	domain := unix.AF_INET
+	if !ipv4 {
+		domain = unix.AF_INET6
+	}
+	sock, err := unix.Socket(domain, unix.SOCK_RAW|unix.SOCK_NONBLOCK|unix.SOCK_CLOEXEC, unix.IPPROTO_TCP)
+	if err != nil {
+		fmt.Println(fmt.Sprintf("Create socket error:%s", err.Error()))
+		return nil, err
+	}
+	conn := &icmpConn{fd: sock, ipv4: ipv4, privileged: true, proto: unix.IPPROTO_TCP}
+	err = conn.setupTCP(source)
+	if err != nil {
+		unix.Close(sock)
+		return nil, err
+	}
+	return conn, nil
+}
+
+func (c *icmpConn) setupTCP(source *net.IPAddr) error {
+	var err error
+	if c.ipv4 {
+		err = unix.SetsockoptInt(c.fd, unix.IPPROTO_IP, unix.IP_HDRINCL, 1)
+		if err != nil {
+			fmt.Println(fmt.Sprintf("Set socket IP_HDRINCL error:%s", err.Error()))
+			return err
+		}
+	} else {
+		// 校验和位于TCP首部第16字节
+		err = unix.SetsockoptInt(c.fd, unix.IPPROTO_IPV6, unix.IPV6_CHECKSUM, 16)
+		if err != nil {
+			fmt.Println(fmt.Sprintf("Set socket IPV6_CHECKSUM error:%s", err.Error()))
+			return err
+		}
+		err = unix.SetsockoptInt(c.fd, unix.IPPROTO_IPV6, unix.IPV6_RECVHOPLIMIT, 1)
+		if err != nil {
+			fmt.Println(fmt.Sprintf("Set socket IPV6_RECVHOPLIMIT error:%s", err.Error()))
+			return err
+		}
+		err = unix.SetsockoptInt(c.fd, unix.IPPROTO_IPV6, unix.IPV6_RECVTCLASS, 1)
+		if err != nil {
+			fmt.Println(fmt.Sprintf("Set socket IPV6_RECVTCLASS error:%s", err.Error()))
+			return err
+		}
+	}
+	if source == nil {
+		return nil
+	}
+	err = unix.Bind(c.fd, sockaddr(source))
+	if err != nil {
+		fmt.Println(fmt.Sprintf("Bind SourceAddr:%s error:%s", source.String(), err.Error()))
+		return err
+	}
+	return nil
+}
+
+// recvTCP 从TCP原始套接字接收一个报文段，IPv4带有IP首部，IPv6只有TCP首部
+func (c *icmpConn) recvTCP() (icmpPacket, error) {
+	if c.ipv4 {
+		header := &c.slot().v4h
+		bytes, oob, _, err := c.recvmsg(0)
+		if err != nil {
+			return nil, err
+		}
+		c.stampRecv(oob)
+		datagram, err := parseIPv4Header(header, bytes)
+		if err != nil {
+			return nil, &parseError{err: err}
+		}
+		seg, err := parseTCP(datagram[header.Len:])
+		if err != nil {
+			return nil, &parseError{err: err}
+		}
+		seg.srcIP, seg.ttl, seg.tos, seg.options = header.Src, header.TTL, header.TOS, header.Options
+		return seg, nil
+	}
+
+	bytes, oob, from, err := c.recvmsg(0)
+	if err != nil {
+		return nil, err
+	}
+	c.stampRecv(oob)
+	seg, err := parseTCP(bytes)
+	if err != nil {
+		return nil, &parseError{err: err}
+	}
+	if sa, ok := from.(*unix.SockaddrInet6); ok {
+		seg.srcIP = net.IP(sa.Addr[:])
+	}
+	seg.ttl = parseHopLimit(oob)
+	seg.tos = parseCmsgInt(oob, unix.IPPROTO_IPV6, unix.IPV6_TCLASS)
+	return seg, nil
+}
+
+// tcpSourcePort TCP探测使用的源端口，由ID得到，位于高端口
+func (p *Pinger) tcpSourcePort() int {
+	return 0x8000 | p.id&0x7fff
+}
+
+// tcpISN 将ID和序号编码到SYN的初始序号中，SYN-ACK和RST的确认号为其加1
+func (p *Pinger) tcpISN(seq int) uint32 {
+	return uint32(p.id&0xffff)<<16 | uint32(seq&0xffff)
+}
+
+// sendTCP 通过原始套接字发送SYN
+func (p *Pinger) sendTCP(conn *icmpConn) error {
+	seg := make([]byte, tcpHeaderLen)
+	binary.BigEndian.PutUint16(seg[0:2], uint16(p.tcpSourcePort()))
+	binary.BigEndian.PutUint16(seg[2:4], uint16(p.Port))
+	binary.BigEndian.PutUint32(seg[4:8], p.tcpISN(p.sequence))
+	seg[12] = tcpHeaderLen / 4 << 4
+	seg[13] = tcpFlagSYN
+	binary.BigEndian.PutUint16(seg[14:16], tcpSynWindow)
+
+	var err error
+	sentAt := time.Now()
+	if conn.ipv4 {
+		binary.BigEndian.PutUint16(seg[16:18], tcpChecksum(p.SourceIpAddr.IP, p.TargetIpaddr.IP, seg))
+		header := &ipv4.Header{
+			TOS:     p.tos(),
+			TTL:     p.TTL,
+			Flags:   ipv4.DontFragment,
+			Src:     p.SourceIpAddr.IP,
+			Dst:     p.TargetIpaddr.IP,
+			Options: p.ipOptions,
+		}
+		hdrLen := ipv4HeaderLen(header)
+		b := make([]byte, hdrLen+len(seg))
+		err = putIPv4Header(b, header, len(b), unix.IPPROTO_TCP)
+		if err != nil {
+			return err
+		}
+		copy(b[hdrLen:], seg)
+		err = conn.sendTo(b, p.TargetIpaddr)
+	} else {
+		err = conn.sendMarked(seg, sockaddr(p.TargetIpaddr), p.TTL, p.tos())
+	}
+	if err != nil {
+		return err
+	}
+	p.sentAt[p.sequence] = sentAt
+	p.markSent(len(seg))
+	return nil
+}
+
+// connectTCP 不需要特权的TCP探测：在后台协程中connect目的端口，握手完成或者
+// 收到RST都说明目的地址可达，结果通过r.recv交给Run处理
+func (p *Pinger) connectTCP(ctx context.Context, r *receiver) {
+	seq := p.sequence
+	sentAt := time.Now()
+	dialer := &net.Dialer{
+		Timeout: tcpConnectWait,
+		Control: func(network, address string, c syscall.RawConn) error {
+			var err error
+			ctrlErr := c.Control(func(fd uintptr) {
+				err = p.bindSocket(int(fd))
+				if err == nil {
+					err = p.markSocket(int(fd))
+				}
+			})
+			if ctrlErr != nil {
+				return ctrlErr
+			}
+			return err
+		},
+	}
+	if p.SourceIpAddr != nil {
+		dialer.LocalAddr = &net.TCPAddr{IP: p.SourceIpAddr.IP, Zone: p.SourceIpAddr.Zone}
+	}
+	address := net.JoinHostPort(p.TargetIpaddr.String(), strconv.Itoa(p.Port))
+	seg := &tcpSegment{
+		srcIP:   p.TargetIpaddr.IP,
+		srcPort: p.Port,
+		dstPort: p.tcpSourcePort(),
+		ack:     p.tcpISN(seq) + 1,
+		length:  tcpHeaderLen,
+	}
+
+	r.wg.Add(1)
+	go func() {
+		defer r.wg.Done()
+		conn, err := dialer.DialContext(ctx, "tcp", address)
+		seg.rtt = time.Since(sentAt)
+		switch {
+		case err == nil:
+			seg.flags = tcpFlagSYN | tcpFlagACK
+			// 设置SO_LINGER为0，关闭时发送RST而不是进入TIME_WAIT
+			conn.(*net.TCPConn).SetLinger(0)
+			conn.Close()
+		case errors.Is(err, unix.ECONNREFUSED):
+			seg.flags = tcpFlagRST | tcpFlagACK
+		default:
+			// 超时或者其他错误视为没有应答
+			return
+		}
+		select {
+		case r.recv <- &recvPacket{data: seg, receivedAt: sentAt.Add(seg.rtt)}:
+		case <-r.quit:
+		}
+	}()
+	p.markSent(tcpHeaderLen)
+}
+
+// markSocket 为connect使用的套接字设置TTL、TOS和IPv4选项
+func (p *Pinger) markSocket(fd int) error {
+	if p.ipv4 {
+		err := unix.SetsockoptInt(fd, unix.IPPROTO_IP, unix.IP_TTL, p.TTL)
+		if err != nil {
+			return err
+		}
+		if p.ipOptions != nil {
+			err = unix.SetsockoptString(fd, unix.IPPROTO_IP, unix.IP_OPTIONS, string(p.ipOptions))
+			if err != nil {
+				return err
+			}
+		}
+		return unix.SetsockoptInt(fd, unix.IPPROTO_IP, unix.IP_TOS, p.tos())
+	}
+	err := unix.SetsockoptInt(fd, unix.IPPROTO_IPV6, unix.IPV6_UNICAST_HOPS, p.TTL)
+	if err != nil {
+		return err
+	}
+	return unix.SetsockoptInt(fd, unix.IPPROTO_IPV6, unix.IPV6_TCLASS, p.tos())
+}
+
+// processTCP 处理TCP应答，SYN-ACK表示端口开放，RST表示端口关闭，两者都说明目的地址可达
+func (p *Pinger) processTCP(seg *tcpSegment, recv *recvPacket) {
+	if !seg.srcIP.Equal(p.TargetIpaddr.IP) || seg.srcPort != p.Port || seg.dstPort != p.tcpSourcePort() {
+		return
+	}
+	synAck := seg.flags&(tcpFlagSYN|tcpFlagACK) == tcpFlagSYN|tcpFlagACK
+	if !synAck && seg.flags&tcpFlagRST == 0 {
+		return
+	}
+	isn := seg.ack - 1
+	if int(isn>>16) != p.id&0xffff {
+		return
+	}
+	seq := int(isn & 0xffff)
+	rtt := seg.rtt
+	if rtt == 0 {
+		sentAt, ok := p.sentAt[seq]
+		if !ok {
+			return
+		}
+		rtt = recv.receivedAt.Sub(sentAt)
+	}
+	pkt := &Packet{
+		Rtt:      rtt,
+		IPAddr:   p.TargetIpaddr,
+		Addr:     p.TargetAddr,
+		Nbytes:   seg.length,
+		Seq:      seq,
+		Ttl:      seg.ttl,
+		Tos:      seg.tos,
+		ID:       p.id,
+		TCPFlags: int(seg.flags),
+	}
+	if seg.options != nil {
+		pkt.Options = parseIPv4Options(seg.options)
+	}
+	p.stampRtt(pkt, recv)
+	// 确认号中只有16位的序号，按照当前的tracker判断是否重复
+	p.recordReply(p.trackerUUIDs[len(p.trackerUUIDs)-1], pkt)
+}
+
+// tcpChecksum 计算IPv4下TCP的校验和，包含伪首部
+func tcpChecksum(src, dst net.IP, seg []byte) uint16 {
+	pseudo := make([]byte, 12, 12+len(seg))
+	copy(pseudo[0:4], src.To4())
+	copy(pseudo[4:8], dst.To4())
+	pseudo[9] = unix.IPPROTO_TCP
+	binary.BigEndian.PutUint16(pseudo[10:12], uint16(len(seg)))
+	return internetChecksum(append(pseudo, seg...))
+}
+
+// internetChecksum RFC 1071的互联网校验和
+func internetChecksum(b []byte) uint16 {
+	var sum uint32
+	for i := 0; i+1 < len(b); i += 2 {
+		sum += uint32(binary.BigEndian.Uint16(b[i : i+2]))
+	}
+	if len(b)%2 == 1 {
+		sum += uint32(b[len(b)-1]) << 8
+	}
+	for sum>>16 != 0 {
+		sum = sum&0xffff + sum>>16
+	}
+	return ^uint16(sum)
+}
@@ -0,0 +1,159 @@
+package shlping
+
+import (
+	"fmt"
+	"golang.org/x/net/icmp"
+	"golang.org/x/sys/unix"
+	"math"
+	"net"
+	"time"
+	"unsafe"
+)
+
+// TimestampSource 计算RTT使用的时间戳的来源
+type TimestampSource int
+
+const (
+	// TimestampUser 接收协程或者发送前在用户态调用time.Now得到的时间，包含调度的延迟
+	TimestampUser TimestampSource = iota
+	// TimestampSoftware 内核协议栈的软件时间戳，接收时为网卡驱动交给协议栈的时间，
+	// 发送时为驱动将数据包交给网卡的时间
+	TimestampSoftware
+	// TimestampHardware 网卡的硬件时间戳，只有收发都是硬件时间戳时才使用。
+	// 不会通过SIOCSHWTSTAMP配置网卡，需要事先在网卡上开启（如hwstamp_ctl -i eth0 -t 1 -r 1）
+	TimestampHardware
+)
+
+func (s TimestampSource) String() string {
+	switch s {
+	case TimestampSoftware:
+		return "software"
+	case TimestampHardware:
+		return "hardware"
+	}
+	return "user"
+}
+
+// timestampingFlags 请求软件和硬件的收发时间戳。OPT_ID为每个发出的数据包编号，
+// OPT_TSONLY使错误队列中的发送时间戳不再携带数据包本身
+const timestampingFlags = unix.SOF_TIMESTAMPING_RX_SOFTWARE | unix.SOF_TIMESTAMPING_TX_SOFTWARE |
+	unix.SOF_TIMESTAMPING_RX_HARDWARE | unix.SOF_TIMESTAMPING_TX_HARDWARE |
+	unix.SOF_TIMESTAMPING_SOFTWARE | unix.SOF_TIMESTAMPING_RAW_HARDWARE |
+	unix.SOF_TIMESTAMPING_OPT_ID | unix.SOF_TIMESTAMPING_OPT_TSONLY
+
+// timespecLen struct timespec的长度
+const timespecLen = int(unsafe.Sizeof(unix.Timespec{}))
+
+// timestampCmsgSpace 接收时间戳控制消息需要的空间，SCM_TIMESTAMPING包含3个timespec
+var timestampCmsgSpace = unix.CmsgSpace(3 * timespecLen)
+
+// kernelStamp 内核给出的时间戳
+type kernelStamp struct {
+	// at 软件时间戳，与time.Now使用同一个时钟，零值表示没有
+	at time.Time
+	// hw 网卡的原始硬件时间戳，属于网卡自己的时钟（PHC），只能与同一网卡的硬件时间戳相减，零值表示没有
+	hw time.Time
+}
+
+// txTimestamp 错误队列中的发送时间戳。实现icmpPacket以便和其他数据包走同一个接收流程，message()为nil
+type txTimestamp struct {
+	// key 发送时间戳的编号，每个套接字从0开始，每发出一个数据包加1
+	key uint32
+	kernelStamp
+}
+
+func (t *txTimestamp) src() net.IP { return nil }
+
+func (t *txTimestamp) hopLimit() int { return 0 }
+
+func (t *txTimestamp) trafficClass() int { return 0 }
+
+func (t *txTimestamp) icmpLen() int { return 0 }
+
+func (t *txTimestamp) message() *icmp.Message { return nil }
+
+// enableTimestamps 开启内核时间戳，不支持SO_TIMESTAMPING时使用只有接收时间戳的SO_TIMESTAMPNS
+func (c *icmpConn) enableTimestamps() error {
+	err := unix.SetsockoptInt(c.fd, unix.SOL_SOCKET, unix.SO_TIMESTAMPING, timestampingFlags)
+	if err == nil {
+		c.txTimestamps = true
+		return nil
+	}
+	err = unix.SetsockoptInt(c.fd, unix.SOL_SOCKET, unix.SO_TIMESTAMPNS, 1)
+	if err != nil {
+		fmt.Println(fmt.Sprintf("Set socket SO_TIMESTAMPNS error:%s", err.Error()))
+		return err
+	}
+	return nil
+}
+
+// parseKernelStamp 从控制消息中解析内核的软件和硬件时间戳，都没有时返回false
+func parseKernelStamp(oob []byte) (kernelStamp, bool) {
+	var stamp kernelStamp
+	if data := parseCmsgBytes(oob, unix.SOL_SOCKET, unix.SCM_TIMESTAMPING); len(data) >= 3*timespecLen {
+		// 依次为软件时间戳、已经弃用的字段和原始的硬件时间戳
+		stamp.at, _ = timespecAt(data)
+		stamp.hw, _ = timespecAt(data[2*timespecLen:])
+	} else if data := parseCmsgBytes(oob, unix.SOL_SOCKET, unix.SCM_TIMESTAMPNS); len(data) >= timespecLen {
+		stamp.at, _ = timespecAt(data)
+	}
+	return stamp, !stamp.at.IsZero() || !stamp.hw.IsZero()
+}
+
+// timespecAt 将b开头的timespec转换为时间，全为0表示没有时间戳
+func timespecAt(b []byte) (time.Time, bool) {
+	ts := *(*unix.Timespec)(unsafe.Pointer(&b[0]))
+	if ts.Sec == 0 && ts.Nsec == 0 {
+		return time.Time{}, false
+	}
+	return time.Unix(int64(ts.Sec), int64(ts.Nsec)), true
+}
+
+// stampRecv 记录最近一次接收的内核时间戳，没有时清空
+func (c *icmpConn) stampRecv(oob []byte) {
+	c.rxStamp, c.rxStamped = parseKernelStamp(oob)
+}
+
+// recordTxKeys 记录刚刚发出的探测包对应的发送时间戳编号。编号按照套接字上成功的sendmsg次数分配，
+// 从first到conn.sends之前的编号都属于这个探测包
+func (p *Pinger) recordTxKeys(conn *icmpConn, seq int, first uint32) {
+	if conn == nil || !conn.txTimestamps {
+		return
+	}
+	for key := first; key != conn.sends; key++ {
+		p.txSeqs[key] = seq
+		// 一直没有收到的发送时间戳（如驱动不支持）不会无限累积
+		delete(p.txSeqs, key-math.MaxUint16)
+	}
+}
+
+// processTxTimestamp 保存探测包的发送时间戳
+func (p *Pinger) processTxTimestamp(ts *txTimestamp) {
+	seq, ok := p.txSeqs[ts.key]
+	if !ok {
+		return
+	}
+	delete(p.txSeqs, ts.key)
+	// 一个探测包有多个编号时使用最早的发送时间戳
+	if _, ok := p.txStamps[seq]; !ok {
+		p.txStamps[seq] = ts.kernelStamp
+	}
+}
+
+// stampRtt 有内核发送时间戳时重新计算RTT，并记录收发时间的来源。硬件时间戳与软件时间戳、
+// 用户态时间不在同一个时钟域，只有收发都有硬件时间戳时才使用，否则使用软件时间戳
+func (p *Pinger) stampRtt(pkt *Packet, recv *recvPacket) {
+	pkt.RecvTimestamp = recv.source
+	tx, ok := p.txStamps[pkt.Seq]
+	if !ok {
+		return
+	}
+	switch {
+	case !tx.hw.IsZero() && !recv.hwStamp.IsZero():
+		pkt.Rtt = recv.hwStamp.Sub(tx.hw)
+		pkt.SendTimestamp, pkt.RecvTimestamp = TimestampHardware, TimestampHardware
+	case !tx.at.IsZero():
+		pkt.Rtt = recv.receivedAt.Sub(tx.at)
+		pkt.SendTimestamp = TimestampSoftware
+	}
+}
@@ -0,0 +1,382 @@
+package shlping
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/sys/unix"
+	"math"
+	"math/rand"
+	"net"
+	"time"
+)
+
+// ProbeType traceroute探测包的类型
+type ProbeType int
+
+const (
+	// ProbeICMP 使用ICMP echo请求探测，相当于traceroute -I
+	ProbeICMP ProbeType = iota
+	// ProbeUDP 使用发往高端口的UDP数据报探测，traceroute的默认方式
+	ProbeUDP
+	// ProbeTCP 向目的端口发送TCP SYN探测，目前只有Pinger支持
+	ProbeTCP
+)
+
+const (
+	// udpHeaderLen UDP首部长度
+	udpHeaderLen = 8
+	// udpBasePort traceroute默认的UDP起始目的端口
+	udpBasePort = 33434
+)
+
+// HopProbe 某一跳的一次探测结果
+type HopProbe struct {
+	// Addr 应答的地址，为nil表示超时
+	Addr *net.IPAddr
+	// Rtt 探测的往返时间
+	Rtt time.Duration
+	// Type 应答的ICMP类型，如超时、目的不可达、echo应答
+	Type icmp.Type
+	// Code 应答的ICMP代码
+	Code int
+}
+
+// Hop traceroute中的一跳
+type Hop struct {
+	// TTL 探测包的TTL
+	TTL int
+	// Probes 每次探测的结果，长度为Tracer.Probes
+	Probes []*HopProbe
+}
+
+// Tracer 通过逐跳增加TTL发送探测包，根据路由器返回的ICMP超时和目的不可达报文得到路径
+type Tracer struct {
+	// FirstTTL 起始TTL，默认为1
+	FirstTTL int
+	// MaxTTL 最大TTL，默认为30
+	MaxTTL int
+	// Probes 每一跳的探测次数，默认为3
+	Probes int
+	// Timeout 每一跳等待应答的时间，默认为3秒
+	Timeout time.Duration
+	// ProbeType 探测包的类型，默认为ProbeUDP。ICMP探测使用原始套接字，需要特权；
+	// UDP探测与Pinger的UDP探测相同，使用普通的UDP套接字，差错报文从错误队列中取出
+	ProbeType ProbeType
+	// Port UDP探测的起始目的端口，每个探测包加1，默认为33434
+	Port int
+	// Size 探测包负载的大小
+	Size int
+
+	// OnHop 每一跳探测完成时触发
+	OnHop func(*Hop)
+
+	// SourceIpAddr Run时实际使用的源地址
+	SourceIpAddr *net.IPAddr
+	// SourceAddr 指定源地址，为空时根据路由自动选择
+	SourceAddr string
+	// 目的地址
+	TargetIpaddr *net.IPAddr
+	TargetAddr   string
+
+	// id ICMP探测的ID，UDP探测时为内核分配的源端口
+	id       int
+	sequence int
+	// network 为"ip","ip4"
+	network string
+}
+
+// NewTracer 新建一个Tracer
+func NewTracer(addr string) (*Tracer, error) {
+	r := rand.New(rand.NewSource(getSeed()))
+	t := &Tracer{
+		FirstTTL:   1,
+		MaxTTL:     30,
+		Probes:     3,
+		Timeout:    3 * time.Second,
+		ProbeType:  ProbeUDP,
+		Port:       udpBasePort,
+		TargetAddr: addr,
+		id:         r.Intn(math.MaxUint16),
+		network:    "ip4",
+	}
+	return t, t.Resolve()
+}
+
+// Resolve 解析目的地址，目前只支持IPv4
+func (t *Tracer) Resolve() error {
+	if len(t.TargetAddr) == 0 {
+		return errors.New("addr cannot be empty")
+	}
+	ipaddr, err := net.ResolveIPAddr(t.network, t.TargetAddr)
+	if err != nil {
+		return err
+	}
+	if !isIPv4(ipaddr.IP) {
+		return errors.New("traceroute only supports IPv4")
+	}
+	t.TargetIpaddr = ipaddr
+	return nil
+}
+
+// Run 开始traceroute，到达目的地址或者达到MaxTTL后返回每一跳的结果
+func (t *Tracer) Run() ([]*Hop, error) {
+	return t.RunWithContext(context.Background())
+}
+
+// RunWithContext 与Run相同，ctx被取消时返回已经完成的跳和ctx.Err()
+func (t *Tracer) RunWithContext(ctx context.Context) ([]*Hop, error) {
+	var err error
+	if t.TargetIpaddr == nil {
+		err = t.Resolve()
+	}
+	if err != nil {
+		return nil, err
+	}
+	err = t.checkProbeType()
+	if err != nil {
+		return nil, err
+	}
+	err = t.checkTTL()
+	if err != nil {
+		return nil, err
+	}
+	if t.Probes <= 0 {
+		return nil, fmt.Errorf("invalid number of probes per hop %d", t.Probes)
+	}
+	t.SourceIpAddr, err = selectSource(t.network, t.SourceAddr, t.TargetIpaddr, 0)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := t.listen()
+	if err != nil {
+		return nil, err
+	}
+	defer conn.close()
+	r, err := newReceiver()
+	if err != nil {
+		return nil, err
+	}
+	r.start(conn)
+	defer r.stop()
+
+	var hops []*Hop
+	for ttl := t.FirstTTL; ttl <= t.MaxTTL; ttl++ {
+		hop, err := t.probeHop(ctx, conn, r, ttl)
+		hops = append(hops, hop)
+		if err != nil {
+			return hops, err
+		}
+		if handler := t.OnHop; handler != nil {
+			handler(hop)
+		}
+		if t.lastHop(hop) {
+			break
+		}
+	}
+	return hops, nil
+}
+
+// probeHop 以同一TTL同时发送Probes个探测包，等待所有应答或者超时
+func (t *Tracer) probeHop(ctx context.Context, conn *icmpConn, r *receiver, ttl int) (*Hop, error) {
+	hop := &Hop{TTL: ttl, Probes: make([]*HopProbe, t.Probes)}
+	sentAt := make([]time.Time, t.Probes)
+	// pending 还未收到应答的序号到探测下标的映射
+	pending := make(map[int]int, t.Probes)
+	for i := range hop.Probes {
+		hop.Probes[i] = &HopProbe{}
+		seq := t.nextSequence()
+		sentAt[i] = time.Now()
+		err := t.sendProbe(conn, ttl, seq, t.Size, 0)
+		if err != nil {
+			return hop, err
+		}
+		pending[seq] = i
+	}
+
+	timeout := time.NewTimer(t.Timeout)
+	defer timeout.Stop()
+	for len(pending) > 0 {
+		select {
+		case <-ctx.Done():
+			return hop, ctx.Err()
+		case <-timeout.C:
+			return hop, nil
+		case err := <-r.errs:
+			return hop, err
+		case recv := <-r.recv:
+			seq, ok := t.matchProbe(recv.data)
+			if !ok {
+				continue
+			}
+			i, ok := pending[seq]
+			if !ok {
+				continue
+			}
+			delete(pending, seq)
+			hop.Probes[i] = &HopProbe{
+				Addr: &net.IPAddr{IP: append(net.IP(nil), recv.data.src()...)},
+				Rtt:  recv.receivedAt.Sub(sentAt[i]),
+			}
+			// 应用程序的UDP应答没有ICMP报文
+			if msg := recv.data.message(); msg != nil {
+				hop.Probes[i].Type, hop.Probes[i].Code = msg.Type, msg.Code
+			}
+		}
+	}
+	return hop, nil
+}
+
+// lastHop 到达目的地址，或者该跳的应答几乎都是目的不可达时结束，与traceroute相同
+func (t *Tracer) lastHop(hop *Hop) bool {
+	unreachable := 0
+	for _, probe := range hop.Probes {
+		if probe.Addr == nil {
+			continue
+		}
+		if probe.Addr.IP.Equal(t.TargetIpaddr.IP) {
+			return true
+		}
+		if probe.Type == ipv4.ICMPTypeDestinationUnreachable {
+			unreachable++
+		}
+	}
+	return unreachable > 0 && unreachable >= len(hop.Probes)-1
+}
+
+func (t *Tracer) nextSequence() int {
+	t.sequence = (t.sequence + 1) & math.MaxUint16
+	return t.sequence
+}
+
+// checkProbeType Tracer只支持ICMP和UDP探测，负载大小不能为负数
+func (t *Tracer) checkProbeType() error {
+	if t.ProbeType != ProbeICMP && t.ProbeType != ProbeUDP {
+		return fmt.Errorf("unsupported probe type %d", t.ProbeType)
+	}
+	if t.Size < 0 {
+		return fmt.Errorf("invalid probe size %d", t.Size)
+	}
+	return nil
+}
+
+// checkTTL 检查TTL的范围，与traceroute相同，1 <= FirstTTL <= MaxTTL <= 255
+func (t *Tracer) checkTTL() error {
+	if t.MaxTTL < 1 || t.MaxTTL > math.MaxUint8 {
+		return fmt.Errorf("invalid max TTL %d, must be between 1 and %d", t.MaxTTL, math.MaxUint8)
+	}
+	if t.FirstTTL < 1 || t.FirstTTL > t.MaxTTL {
+		return fmt.Errorf("invalid first TTL %d, must be between 1 and max TTL %d", t.FirstTTL, t.MaxTTL)
+	}
+	return nil
+}
+
+// listen 按照探测包的类型建立套接字：ICMP探测使用原始套接字，手动填写IP首部发送，
+// 也用于接收ICMP应答；UDP探测使用UDP套接字，ID为内核分配的源端口
+func (t *Tracer) listen() (*icmpConn, error) {
+	if t.ProbeType != ProbeUDP {
+		return listenICMP(true, true, t.SourceIpAddr, 0)
+	}
+	conn, err := listenUDP(true, t.SourceIpAddr, 0)
+	if err != nil {
+		return nil, err
+	}
+	t.id = conn.id
+	return conn, nil
+}
+
+// sendProbe 发送一个TTL为ttl、负载为size字节的探测包。UDP探测的目的端口为Port+seq，
+// TTL通过控制消息设置，是否设置DF由套接字的IP_MTU_DISCOVER决定，flags只对ICMP探测生效
+func (t *Tracer) sendProbe(conn *icmpConn, ttl, seq, size int, flags ipv4.HeaderFlags) error {
+	if t.ProbeType == ProbeUDP {
+		dst := sockaddr(t.TargetIpaddr).(*unix.SockaddrInet4)
+		dst.Port = (t.Port + seq) & math.MaxUint16
+		return conn.sendMarked(udpProbePayload(seq, size), dst, ttl, 0)
+	}
+	b, err := t.marshalProbe(ttl, seq, size, flags)
+	if err != nil {
+		return err
+	}
+	return conn.sendTo(b, t.TargetIpaddr)
+}
+
+// marshalProbe 生成带IP首部的ICMP探测包，size为负载的大小
+func (t *Tracer) marshalProbe(ttl, seq, size int, flags ipv4.HeaderFlags) ([]byte, error) {
+	data := &ICMPv4Data{
+		IPv4Header: &ipv4.Header{
+			TTL:   ttl,
+			ID:    seq,
+			Flags: flags,
+			Src:   t.SourceIpAddr.IP,
+			Dst:   t.TargetIpaddr.IP,
+		},
+		ICMPData: &icmp.Message{
+			Type: ipv4.ICMPTypeEcho,
+			Body: &icmp.Echo{
+				ID:   t.id,
+				Seq:  seq,
+				Data: make([]byte, size),
+			},
+		},
+	}
+	return data.Marshal()
+}
+
+// matchProbe 判断应答是否属于本Tracer的探测包，返回探测包的序号。目的地址的echo应答直接按照ID匹配，
+// 超时和目的不可达报文按照其中引用的原始数据报匹配。UDP探测与Pinger相同，
+// 序号从负载开头取出，负载被截断时根据目的端口推算，目的地址上应用程序的应答也算作到达
+func (t *Tracer) matchProbe(data icmpPacket) (int, bool) {
+	if d, ok := data.(*udpDatagram); ok {
+		if t.ProbeType != ProbeUDP || !d.srcIP.Equal(t.TargetIpaddr.IP) {
+			return 0, false
+		}
+		return t.udpSequence(d.srcPort, d.payload), true
+	}
+	msg := data.message()
+	if msg == nil {
+		return 0, false
+	}
+	var quoted []byte
+	switch body := msg.Body.(type) {
+	case *icmp.Echo:
+		if msg.Type != ipv4.ICMPTypeEchoReply || t.ProbeType != ProbeICMP || body.ID != t.id {
+			return 0, false
+		}
+		return body.Seq, true
+	case *icmp.TimeExceeded:
+		quoted = body.Data
+	case *icmp.DstUnreach:
+		quoted = body.Data
+	default:
+		return 0, false
+	}
+
+	if t.ProbeType == ProbeUDP {
+		dst, srcPort, dstPort, payload, ok := quotedUDP(quoted, true)
+		if !ok || !dst.Equal(t.TargetIpaddr.IP) || srcPort != t.id {
+			return 0, false
+		}
+		return t.udpSequence(dstPort, payload), true
+	}
+	header, transport, err := parseQuotedIPv4(quoted)
+	if err != nil || !header.Dst.Equal(t.TargetIpaddr.IP) || len(transport) < icmpEchoHeaderLen {
+		return 0, false
+	}
+	// 引用的ICMP首部：类型、代码、校验和、ID、序号
+	if header.Protocol != unix.IPPROTO_ICMP || transport[0] != byte(ipv4.ICMPTypeEcho) ||
+		int(binary.BigEndian.Uint16(transport[4:6])) != t.id {
+		return 0, false
+	}
+	return int(binary.BigEndian.Uint16(transport[6:8])), true
+}
+
+// udpSequence 从UDP探测包的负载或者目的端口中得到序号
+func (t *Tracer) udpSequence(port int, payload []byte) int {
+	if seq, ok := payloadSequence(payload); ok {
+		return seq
+	}
+	return (port - t.Port) & math.MaxUint16
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"github.com/Senhnn/go_tool/shlping"
+	"golang.org/x/net/ipv4"
+	"os"
+	"os/signal"
+	"strings"
+	"time"
+)
+
+var usage = `
+用法:
+    traceroute [-I] [-f first_ttl] [-m max_ttl] [-q nqueries] [-w wait] [-p port] host
+样例:
+	-I：使用ICMP echo探测，默认使用UDP
+	-f：起始TTL（默认1）
+	-m：最大TTL（默认30）
+	-q：每一跳的探测次数（默认3）
+	-w：每一跳等待应答的时间（单位为s，默认3）
+	-p：UDP探测的起始目的端口（默认33434）
+    # 使用UDP探测
+    traceroute www.google.com
+
+    # 使用ICMP探测，最多15跳
+    traceroute -I -m 15 www.google.com
+`
+
+func main() {
+	useICMP := flag.Bool("I", false, "")
+	first := flag.Int("f", 1, "")
+	max := flag.Int("m", 30, "")
+	queries := flag.Int("q", 3, "")
+	wait := flag.Float64("w", 3, "")
+	port := flag.Int("p", 33434, "")
+
+	flag.Usage = func() {
+		fmt.Print(usage)
+	}
+	flag.Parse()
+
+	if flag.NArg() == 0 {
+		flag.Usage()
+		return
+	}
+
+	host := flag.Arg(0)
+	tracer, err := shlping.NewTracer(host)
+	if err != nil {
+		fmt.Println("ERROR:", err)
+		return
+	}
+	tracer.FirstTTL = *first
+	tracer.MaxTTL = *max
+	tracer.Probes = *queries
+	tracer.Timeout = time.Duration(*wait * float64(time.Second))
+	tracer.Port = *port
+	if *useICMP {
+		tracer.ProbeType = shlping.ProbeICMP
+	}
+	tracer.OnHop = printHop
+
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer cancel()
+
+	fmt.Printf("traceroute to %s (%s), %d hops max\n", tracer.TargetAddr, tracer.TargetIpaddr, tracer.MaxTTL)
+	_, err = tracer.RunWithContext(ctx)
+	if err != nil && err != context.Canceled {
+		fmt.Println("Failed to trace target host:", err)
+	}
+}
+
+// printHop 按照traceroute的格式输出一跳，同一地址连续出现时只输出一次
+func printHop(hop *shlping.Hop) {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%2d", hop.TTL)
+	var last string
+	for _, probe := range hop.Probes {
+		if probe.Addr == nil {
+			b.WriteString(" *")
+			continue
+		}
+		if addr := probe.Addr.String(); addr != last {
+			fmt.Fprintf(&b, "  %s", addr)
+			last = addr
+		}
+		fmt.Fprintf(&b, "  %.3f ms%s", float64(probe.Rtt)/float64(time.Millisecond), annotation(probe))
+	}
+	fmt.Println(b.String())
+}
+
+// annotation 目的不可达时的标记，与traceroute相同
+func annotation(probe *shlping.HopProbe) string {
+	if probe.Type != ipv4.ICMPTypeDestinationUnreachable {
+		return ""
+	}
+	switch probe.Code {
+	case 0:
+		return " !N"
+	case 1:
+		return " !H"
+	case 2:
+		return " !P"
+	case 3:
+		// 端口不可达说明已经到达目的地址
+		return ""
+	case 4:
+		return " !F"
+	case 9, 10, 13:
+		return " !X"
+	default:
+		return fmt.Sprintf(" !<%d>", probe.Code)
+	}
+}
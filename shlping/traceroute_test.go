@@ -0,0 +1,25 @@
+package shlping
+
+import "testing"
+
+func TestTracerCheckTTL(t *testing.T) {
+	tests := []struct {
+		first, max int
+		wantErr    bool
+	}{
+		{first: 1, max: 30},
+		{first: 1, max: 1},
+		{first: 255, max: 255},
+		{first: 0, max: 30, wantErr: true},
+		{first: -1, max: 30, wantErr: true},
+		{first: 1, max: 0, wantErr: true},
+		{first: 1, max: 256, wantErr: true},
+		{first: 5, max: 3, wantErr: true},
+	}
+	for _, tt := range tests {
+		tracer := &Tracer{FirstTTL: tt.first, MaxTTL: tt.max}
+		if err := tracer.checkTTL(); (err != nil) != tt.wantErr {
+			t.Errorf("checkTTL(%d, %d) = %v, want error %v", tt.first, tt.max, err, tt.wantErr)
+		}
+	}
+}
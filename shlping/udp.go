@@ -0,0 +1,275 @@
+package shlping
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv6"
+	"golang.org/x/sys/unix"
+	"net"
+	"time"
+)
+
+const (
+	// udpSeqLen UDP探测包负载开头的序号长度
+	udpSeqLen = 2
+	// udpPortRange 不指定端口时使用的目的端口数，从udpBasePort开始到65535
+	udpPortRange = 1<<16 - udpBasePort
+)
+
+// udpDatagram 目的地址上的应用程序发回的UDP数据报。
+// 实现icmpPacket以便和ICMP报文走同一个接收流程，message()为nil
+type udpDatagram struct {
+	srcIP   net.IP
+	srcPort int
+	ttl     int
+	tos     int
+	payload []byte
+	// options IPv4首部中的选项
+	options []byte
+}
+
+func (d *udpDatagram) src() net.IP { return d.srcIP }
+
+func (d *udpDatagram) hopLimit() int { return d.ttl }
+
+func (d *udpDatagram) trafficClass() int { return d.tos }
+
+func (d *udpDatagram) icmpLen() int { return len(d.payload) }
+
+func (d *udpDatagram) message() *icmp.Message { return nil }
+
+// listenUDP 建立发送UDP探测包的套接字，不需要特权。端口不可达等差错通过IP_RECVERR
+// 从错误队列中取出，ID为内核分配的本地端口
+func listenUDP(ipv4 bool, source *net.IPAddr, hopLimit int) (*icmpConn, error) {
+	domain := unix.AF_INET
+	if !ipv4 {
+		domain = unix.AF_INET6
+	}
+	sock, err := unix.Socket(domain, unix.SOCK_DGRAM|unix.SOCK_NONBLOCK|unix.SOCK_CLOEXEC, unix.IPPROTO_UDP)
+	if err != nil {
+		fmt.Println(fmt.Sprintf("Create socket error:%s", err.Error()))
+		return nil, err
+	}
+	conn := &icmpConn{fd: sock, ipv4: ipv4, proto: unix.IPPROTO_UDP}
+	err = conn.setup(source, hopLimit)
+	if err != nil {
+		unix.Close(sock)
+		return nil, err
+	}
+	return conn, nil
+}
+
+// recvUDP 接收应用程序的应答，IP首部中的信息从控制消息中获取
+func (c *icmpConn) recvUDP() (icmpPacket, error) {
+	bytes, oob, from, err := c.recvmsg(0)
+	if err != nil {
+		return nil, err
+	}
+	c.stampRecv(oob)
+	d := &udpDatagram{payload: bytes, srcPort: sockaddrPort(from)}
+	if c.ipv4 {
+		if sa, ok := from.(*unix.SockaddrInet4); ok {
+			d.srcIP = net.IP(sa.Addr[:])
+		}
+		d.ttl = parseTTL(oob)
+		if tos := parseCmsgBytes(oob, unix.IPPROTO_IP, unix.IP_TOS); tos != nil {
+			d.tos = int(tos[0])
+		}
+		d.options = parseCmsgBytes(oob, unix.IPPROTO_IP, unix.IP_RECVOPTS)
+		return d, nil
+	}
+	if sa, ok := from.(*unix.SockaddrInet6); ok {
+		d.srcIP = net.IP(sa.Addr[:])
+	}
+	d.ttl = parseHopLimit(oob)
+	d.tos = parseCmsgInt(oob, unix.IPPROTO_IPV6, unix.IPV6_TCLASS)
+	return d, nil
+}
+
+// udpPort 序号为seq的探测包的目的端口，没有指定Port时与traceroute相同，每个探测包加1
+func (p *Pinger) udpPort(seq int) int {
+	if p.Port != 0 {
+		return p.Port
+	}
+	return udpBasePort + seq%udpPortRange
+}
+
+// udpProbePayload 生成UDP探测包的负载，开头为序号，目的主机的应用程序原样返回负载时也可以匹配。
+// size小于序号长度时不携带序号
+func udpProbePayload(seq, size int) []byte {
+	payload := make([]byte, max(size, 0))
+	if len(payload) >= udpSeqLen {
+		binary.BigEndian.PutUint16(payload, uint16(seq))
+	}
+	return payload
+}
+
+// payloadSequence 从UDP探测包的负载开头取出序号
+func payloadSequence(payload []byte) (int, bool) {
+	if len(payload) < udpSeqLen {
+		return 0, false
+	}
+	return int(binary.BigEndian.Uint16(payload)), true
+}
+
+// sendUDP 发送一个UDP探测包，负载开头为序号
+func (p *Pinger) sendUDP(conn *icmpConn) error {
+	payload := udpProbePayload(p.sequence, p.Size)
+	dst := sockaddr(p.TargetIpaddr)
+	switch sa := dst.(type) {
+	case *unix.SockaddrInet4:
+		sa.Port = p.udpPort(p.sequence)
+	case *unix.SockaddrInet6:
+		sa.Port = p.udpPort(p.sequence)
+	}
+	sentAt := time.Now()
+	err := conn.sendMarked(payload, dst, p.TTL, p.tos())
+	if err != nil {
+		return err
+	}
+	p.sentAt[p.sequence] = sentAt
+	p.markSent(udpHeaderLen + len(payload))
+	return nil
+}
+
+// udpSequence 从负载或者目的端口中得到探测包的序号。差错报文引用的数据报可能只包含UDP首部，
+// 这时只有没有指定Port时才能根据目的端口推算出最近一个使用该端口的探测包
+func (p *Pinger) udpSequence(port int, payload []byte) (int, bool) {
+	if seq, ok := payloadSequence(payload); ok {
+		return seq, true
+	}
+	if p.Port != 0 || port < udpBasePort {
+		return 0, false
+	}
+	seq := port - udpBasePort
+	for seq+udpPortRange < p.sequence {
+		seq += udpPortRange
+	}
+	return seq, true
+}
+
+// processUDP 处理目的地址上的应用程序发回的应答
+func (p *Pinger) processUDP(d *udpDatagram, recv *recvPacket) {
+	if !d.srcIP.Equal(p.TargetIpaddr.IP) {
+		return
+	}
+	seq, ok := p.udpSequence(d.srcPort, d.payload)
+	if !ok || (p.Port != 0 && d.srcPort != p.Port) {
+		return
+	}
+	sentAt, ok := p.sentAt[seq]
+	if !ok {
+		return
+	}
+	pkt := &Packet{
+		Rtt:    recv.receivedAt.Sub(sentAt),
+		IPAddr: p.TargetIpaddr,
+		Addr:   p.TargetAddr,
+		Nbytes: len(d.payload),
+		Seq:    seq,
+		Ttl:    d.ttl,
+		Tos:    d.tos,
+		ID:     p.id,
+	}
+	if d.options != nil {
+		pkt.Options = parseIPv4Options(d.options)
+	}
+	p.stampRtt(pkt, recv)
+	p.recordReply(p.trackerUUIDs[len(p.trackerUUIDs)-1], pkt)
+}
+
+// processUDPError 处理UDP探测包的差错报文，目的地址发回的端口不可达算作应答，
+// 其他差错与ICMP探测相同
+func (p *Pinger) processUDPError(recv *recvPacket) {
+	data := recv.data
+	quoted, icmpErr := decodeICMPError(data)
+	if icmpErr == nil {
+		return
+	}
+	dst, srcPort, dstPort, payload, ok := quotedUDP(quoted, p.ipv4)
+	if !ok || !dst.Equal(p.TargetIpaddr.IP) || srcPort != p.id {
+		return
+	}
+	seq, ok := p.udpSequence(dstPort, payload)
+	if !ok {
+		return
+	}
+	pkt := &Packet{
+		IPAddr: p.TargetIpaddr,
+		Addr:   p.TargetAddr,
+		Nbytes: data.icmpLen(),
+		Seq:    seq,
+		Ttl:    data.hopLimit(),
+		Tos:    data.trafficClass(),
+		ID:     p.id,
+	}
+	if sentAt, ok := p.sentAt[seq]; ok {
+		pkt.Rtt = recv.receivedAt.Sub(sentAt)
+	}
+	p.stampRtt(pkt, recv)
+	if p.portUnreachable(icmpErr) {
+		pkt.PortUnreachable = true
+		p.recordReply(p.trackerUUIDs[len(p.trackerUUIDs)-1], pkt)
+		return
+	}
+	p.reportError(pkt, icmpErr)
+}
+
+// portUnreachable 差错是否为目的地址发回的端口不可达
+func (p *Pinger) portUnreachable(err error) bool {
+	var unreachable *UnreachableError
+	if !errors.As(err, &unreachable) || !unreachable.Router.Equal(p.TargetIpaddr.IP) {
+		return false
+	}
+	if p.ipv4 {
+		return unreachable.Code == 3
+	}
+	return unreachable.Code == 4
+}
+
+// quotedUDP 从差错报文引用的数据报中解析UDP探测包，返回目的地址、端口和负载
+func quotedUDP(quoted []byte, v4 bool) (net.IP, int, int, []byte, bool) {
+	var dst net.IP
+	var transport []byte
+	if v4 {
+		header, rest, err := parseQuotedIPv4(quoted)
+		if err != nil || header.Protocol != unix.IPPROTO_UDP {
+			return nil, 0, 0, nil, false
+		}
+		dst, transport = header.Dst, rest
+	} else {
+		header, err := ipv6.ParseHeader(quoted)
+		if err != nil || header.NextHeader != unix.IPPROTO_UDP {
+			return nil, 0, 0, nil, false
+		}
+		dst, transport = header.Dst, quoted[ipv6.HeaderLen:]
+	}
+	if len(transport) < udpHeaderLen {
+		return nil, 0, 0, nil, false
+	}
+	srcPort := int(binary.BigEndian.Uint16(transport[0:2]))
+	dstPort := int(binary.BigEndian.Uint16(transport[2:4]))
+	return dst, srcPort, dstPort, transport[udpHeaderLen:], true
+}
+
+// udpHeader 在负载前加上UDP首部，校验和为0
+func udpHeader(srcPort, dstPort int, payload []byte) []byte {
+	b := make([]byte, udpHeaderLen, udpHeaderLen+len(payload))
+	binary.BigEndian.PutUint16(b[0:2], uint16(srcPort))
+	binary.BigEndian.PutUint16(b[2:4], uint16(dstPort))
+	binary.BigEndian.PutUint16(b[4:6], uint16(udpHeaderLen+len(payload)))
+	return append(b, payload...)
+}
+
+// sockaddrPort 返回套接字地址中的端口
+func sockaddrPort(sa unix.Sockaddr) int {
+	switch sa := sa.(type) {
+	case *unix.SockaddrInet4:
+		return sa.Port
+	case *unix.SockaddrInet6:
+		return sa.Port
+	}
+	return 0
+}
@@ -0,0 +1,176 @@
+package shlping
+
+import (
+	"bytes"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+	"golang.org/x/sys/unix"
+	"net"
+	"testing"
+	"time"
+)
+
+// testQuotedUDPv4 发往10.2.0.2的UDP探测包，负载开头为序号，截断到IP首部之后的n字节，n<0时不截断
+func testQuotedUDPv4(t *testing.T, proto int, options []byte, srcPort, dstPort, seq, n int) []byte {
+	udp := udpHeader(srcPort, dstPort, udpProbePayload(seq, defaultSize))
+	h := &ipv4.Header{TTL: 1, Src: net.IPv4(10, 1, 0, 1), Dst: net.IPv4(10, 2, 0, 2), Options: options}
+	b := make([]byte, ipv4HeaderLen(h))
+	err := putIPv4Header(b, h, len(b)+len(udp), proto)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b = append(b, udp...)
+	if n >= 0 {
+		b = b[:h.Len+n]
+	}
+	return b
+}
+
+// testQuotedUDPv6 发往fd02::2的UDP探测包，截断到IPv6首部之后的n字节，n<0时不截断
+func testQuotedUDPv6(nextHeader, srcPort, dstPort, seq, n int) []byte {
+	udp := udpHeader(srcPort, dstPort, udpProbePayload(seq, defaultSize))
+	b := append(quotedIPv6Header(testDstV6, len(udp), nextHeader), udp...)
+	if n >= 0 {
+		b = b[:ipv6.HeaderLen+n]
+	}
+	return b
+}
+
+func TestQuotedUDP(t *testing.T) {
+	recordRoute, err := buildIPv4Options(true, TimestampNone)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dst := net.IPv4(10, 2, 0, 2)
+	tests := []struct {
+		name        string
+		quoted      []byte
+		v4          bool
+		wantOK      bool
+		wantDst     net.IP
+		wantPayload int
+	}{
+		{name: "full quote", quoted: testQuotedUDPv4(t, unix.IPPROTO_UDP, nil, 40000, 33434, 7, -1), v4: true, wantOK: true, wantDst: dst, wantPayload: defaultSize},
+		{name: "UDP header only", quoted: testQuotedUDPv4(t, unix.IPPROTO_UDP, nil, 40000, 33434, 7, udpHeaderLen), v4: true, wantOK: true, wantDst: dst},
+		{name: "sequence only", quoted: testQuotedUDPv4(t, unix.IPPROTO_UDP, nil, 40000, 33434, 7, udpHeaderLen+udpSeqLen), v4: true, wantOK: true, wantDst: dst, wantPayload: udpSeqLen},
+		{name: "options", quoted: testQuotedUDPv4(t, unix.IPPROTO_UDP, recordRoute, 40000, 33434, 7, -1), v4: true, wantOK: true, wantDst: dst, wantPayload: defaultSize},
+		{name: "options and UDP header", quoted: testQuotedUDPv4(t, unix.IPPROTO_UDP, recordRoute, 40000, 33434, 7, udpHeaderLen), v4: true, wantOK: true, wantDst: dst},
+		{name: "UDP header truncated", quoted: testQuotedUDPv4(t, unix.IPPROTO_UDP, nil, 40000, 33434, 7, udpHeaderLen-1), v4: true},
+		{name: "options truncated", quoted: testQuotedUDPv4(t, unix.IPPROTO_UDP, recordRoute, 40000, 33434, 7, -1)[:ipv4.HeaderLen+udpHeaderLen], v4: true},
+		{name: "IP header truncated", quoted: testQuotedUDPv4(t, unix.IPPROTO_UDP, nil, 40000, 33434, 7, -1)[:ipv4.HeaderLen-1], v4: true},
+		{name: "empty", quoted: nil, v4: true},
+		{name: "ICMP", quoted: testQuotedUDPv4(t, unix.IPPROTO_ICMP, nil, 40000, 33434, 7, -1), v4: true},
+		{name: "IPv6 quote as IPv4", quoted: testQuotedUDPv6(unix.IPPROTO_UDP, 40000, 33434, 7, -1), v4: true},
+		{name: "IPv6 full quote", quoted: testQuotedUDPv6(unix.IPPROTO_UDP, 40000, 33434, 7, -1), wantOK: true, wantDst: testDstV6, wantPayload: defaultSize},
+		{name: "IPv6 UDP header only", quoted: testQuotedUDPv6(unix.IPPROTO_UDP, 40000, 33434, 7, udpHeaderLen), wantOK: true, wantDst: testDstV6},
+		{name: "IPv6 UDP header truncated", quoted: testQuotedUDPv6(unix.IPPROTO_UDP, 40000, 33434, 7, udpHeaderLen-1)},
+		{name: "IPv6 header truncated", quoted: testQuotedUDPv6(unix.IPPROTO_UDP, 40000, 33434, 7, -1)[:ipv6.HeaderLen-1]},
+		{name: "IPv6 ICMPv6", quoted: testQuotedUDPv6(unix.IPPROTO_ICMPV6, 40000, 33434, 7, -1)},
+		{name: "IPv6 extension header", quoted: testQuotedUDPv6(0, 40000, 33434, 7, -1)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dst, srcPort, dstPort, payload, ok := quotedUDP(tt.quoted, tt.v4)
+			if ok != tt.wantOK {
+				t.Fatalf("quotedUDP() ok = %v, want %v", ok, tt.wantOK)
+			}
+			if !ok {
+				return
+			}
+			if !dst.Equal(tt.wantDst) || srcPort != 40000 || dstPort != 33434 || len(payload) != tt.wantPayload {
+				t.Errorf("dst %v ports %d %d payload %d bytes, want %v 40000 33434 %d bytes",
+					dst, srcPort, dstPort, len(payload), tt.wantDst, tt.wantPayload)
+			}
+			if len(payload) >= udpSeqLen && !bytes.Equal(payload[:udpSeqLen], []byte{0, 7}) {
+				t.Errorf("payload %x does not start with the sequence", payload)
+			}
+		})
+	}
+}
+
+// 引用的数据报只有UDP首部时根据目的端口推算序号
+func TestUDPSequence(t *testing.T) {
+	tests := []struct {
+		name     string
+		port     int
+		payload  []byte
+		fixed    int
+		sequence int
+		wantSeq  int
+		wantOK   bool
+	}{
+		{name: "payload", port: udpBasePort, payload: []byte{0, 9, 1}, sequence: 10, wantSeq: 9, wantOK: true},
+		{name: "payload with fixed port", port: 53, payload: []byte{1, 0}, fixed: 53, sequence: 300, wantSeq: 256, wantOK: true},
+		{name: "port", port: udpBasePort + 5, sequence: 10, wantSeq: 5, wantOK: true},
+		{name: "port wrapped", port: udpBasePort + 5, sequence: 2*udpPortRange + 10, wantSeq: 2*udpPortRange + 5, wantOK: true},
+		{name: "port below base", port: udpBasePort - 1, sequence: 10},
+		{name: "fixed port", port: 53, fixed: 53, sequence: 10},
+		{name: "one byte payload", port: 53, payload: []byte{0}, fixed: 53, sequence: 10},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := newPinger("10.2.0.2")
+			p.Port, p.sequence = tt.fixed, tt.sequence
+			seq, ok := p.udpSequence(tt.port, tt.payload)
+			if ok != tt.wantOK || (ok && seq != tt.wantSeq) {
+				t.Errorf("udpSequence() = %d %v, want %d %v", seq, ok, tt.wantSeq, tt.wantOK)
+			}
+		})
+	}
+}
+
+func TestProcessUDPError(t *testing.T) {
+	target := net.IPv4(10, 2, 0, 2)
+	// unreachable 目的地址发回的端口不可达
+	unreachable := func(quoted []byte) icmpPacket {
+		data := testICMPv4Error(t, ipv4.ICMPTypeDestinationUnreachable, 3, append([]byte{0, 0, 0, 0}, quoted...))
+		data.IPv4Header.Src = target
+		return data
+	}
+	unreachableV6 := func(quoted []byte) icmpPacket {
+		data := testICMPv6Error(t, ipv6.ICMPTypeDestinationUnreachable, 4, append([]byte{0, 0, 0, 0}, quoted...))
+		data.IPv6Header.Src = testDstV6
+		return data
+	}
+	timeExceeded := func(quoted []byte) icmpPacket {
+		return testICMPv4Error(t, ipv4.ICMPTypeTimeExceeded, 0, append([]byte{0, 0, 0, 0}, quoted...))
+	}
+	tests := []struct {
+		name       string
+		target     string
+		data       icmpPacket
+		wantRecv   int
+		wantErrors int
+	}{
+		{name: "port unreachable", data: unreachable(testQuotedUDPv4(t, unix.IPPROTO_UDP, nil, 40000, udpBasePort+3, 3, -1)), wantRecv: 1},
+		{name: "port unreachable with truncated quote", data: unreachable(testQuotedUDPv4(t, unix.IPPROTO_UDP, nil, 40000, udpBasePort+3, 3, udpHeaderLen)), wantRecv: 1},
+		{name: "time exceeded with truncated quote", data: timeExceeded(testQuotedUDPv4(t, unix.IPPROTO_UDP, nil, 40000, udpBasePort+3, 3, udpHeaderLen)), wantErrors: 1},
+		{name: "port unreachable from router", data: func() icmpPacket {
+			return testICMPv4Error(t, ipv4.ICMPTypeDestinationUnreachable, 3, append([]byte{0, 0, 0, 0}, testQuotedUDPv4(t, unix.IPPROTO_UDP, nil, 40000, udpBasePort+3, 3, -1)...))
+		}(), wantErrors: 1},
+		{name: "other source port", data: unreachable(testQuotedUDPv4(t, unix.IPPROTO_UDP, nil, 40001, udpBasePort+3, 3, -1))},
+		{name: "not sent", data: unreachable(testQuotedUDPv4(t, unix.IPPROTO_UDP, nil, 40000, udpBasePort+4, 4, udpHeaderLen))},
+		{name: "quote too short", data: unreachable(testQuotedUDPv4(t, unix.IPPROTO_UDP, nil, 40000, udpBasePort+3, 3, udpHeaderLen-1))},
+		{name: "ICMPv6 port unreachable", target: "fd02::2", data: unreachableV6(testQuotedUDPv6(unix.IPPROTO_UDP, 40000, udpBasePort+3, 3, -1)), wantRecv: 1},
+		{name: "ICMPv6 port unreachable with truncated quote", target: "fd02::2", data: unreachableV6(testQuotedUDPv6(unix.IPPROTO_UDP, 40000, udpBasePort+3, 3, udpHeaderLen)), wantRecv: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			addr := tt.target
+			if addr == "" {
+				addr = target.String()
+			}
+			p, err := NewPinger(addr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			p.ProbeType, p.id, p.sequence = ProbeUDP, 40000, 4
+			p.sentAt[3] = time.Now()
+			p.awaitingSequences[p.trackerUUIDs[0]][3] = struct{}{}
+			p.processPacket(&recvPacket{data: tt.data, receivedAt: time.Now()})
+			if p.PacketsRecv != tt.wantRecv || p.PacketsErrors != tt.wantErrors {
+				t.Errorf("received %d errors %d, want %d %d", p.PacketsRecv, p.PacketsErrors, tt.wantRecv, tt.wantErrors)
+			}
+		})
+	}
+}